@@ -0,0 +1,403 @@
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	maxImageSize  = 10 << 20
+	fetchTimeout  = 15 * time.Second
+	cacheDuration = 7 * 24 * time.Hour
+	userAgent     = "RedReader/1.0 (+https://redapplications.com)"
+)
+
+var (
+	errInvalidSignature = errors.New("invalid image signature")
+	errNotAnImage       = errors.New("upstream did not return an image")
+	errTooLarge         = errors.New("image too large")
+	errUnsafeRedirect   = errors.New("refusing to follow a redirect to a non-web address")
+	errTooManyRedirects = errors.New("stopped after 10 redirects")
+
+	// ErrPrivateAddress is returned for connections to loopback, private
+	// and link-local addresses
+	ErrPrivateAddress = errors.New("refusing to fetch from a private address")
+)
+
+// Hosts that only serve tracking pixels, stripped rather than proxied
+var trackerHosts = map[string]bool{
+	"feeds.feedburner.com":        true,
+	"feedproxy.google.com":        true,
+	"pixel.wp.com":                true,
+	"stats.wordpress.com":         true,
+	"pixel.quantserve.com":        true,
+	"www.google-analytics.com":    true,
+	"ad.doubleclick.net":          true,
+	"feedads.g.doubleclick.net":   true,
+	"pi.feedsportal.com":          true,
+	"pixel.mathtag.com":           true,
+	"sb.scorecardresearch.com":    true,
+	"b.scorecardresearch.com":     true,
+	"www.facebook.com":            true,
+	"counter.theconversation.com": true,
+}
+
+// Proxy serves third-party images from our own origin so readers' IPs and
+// referrers are not leaked to the image hosts. URLs are HMAC signed so the
+// endpoint cannot be used as an open proxy.
+type Proxy struct {
+	key      []byte
+	cacheDir string
+	client   *http.Client
+}
+
+type cacheMeta struct {
+	ContentType string    `json:"contentType"`
+	Expires     time.Time `json:"expires"`
+}
+
+// New creates a proxy signing with IMAGE_PROXY_KEY and caching under
+// IMAGE_CACHE_DIR. Without a key a random one is used, which invalidates
+// proxied URLs on restart.
+func New() *Proxy {
+	key := []byte(os.Getenv("IMAGE_PROXY_KEY"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+
+	cacheDir := os.Getenv("IMAGE_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "redreader-images")
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		panic(err)
+	}
+
+	return &Proxy{
+		key:      key,
+		cacheDir: cacheDir,
+		client:   &http.Client{Timeout: fetchTimeout, Transport: PublicTransport(), CheckRedirect: CheckRedirect},
+	}
+}
+
+// PublicTransport only connects to public addresses. The check runs on the
+// resolved address of every connection, so neither a hostname pointing
+// inwards nor a redirect can reach services on our own network. Anything
+// fetching URLs given by users should use it.
+func PublicTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: fetchTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublic(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// CheckRedirect is the redirect policy to go with PublicTransport. It only
+// follows redirects to http(s) URLs, and turns away addresses that are
+// private on their face before any connection is attempted.
+func CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errTooManyRedirects
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return errUnsafeRedirect
+	}
+	host := req.URL.Hostname()
+	if ip := net.ParseIP(host); (ip != nil && !isPublic(ip)) || strings.EqualFold(host, "localhost") {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+func isPublic(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsUnspecified()
+}
+
+func (p *Proxy) sign(rawURL string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(rawURL))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the proxied form of an absolute http(s) image URL, leaving
+// anything else untouched
+func (p *Proxy) URL(rawURL string) string {
+	rawURL = strings.TrimSpace(rawURL)
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return rawURL
+	}
+	return "/img/" + p.sign(rawURL) + "/" + base64.RawURLEncoding.EncodeToString([]byte(rawURL))
+}
+
+// RewriteHTML points every image in sanitized article markup at the proxy
+// and removes tracking pixels
+func (p *Proxy) RewriteHTML(content string) string {
+	if !strings.Contains(content, "<") {
+		return content
+	}
+
+	root := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(content), root)
+	if err != nil {
+		return content
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		if node.Type == html.ElementNode && node.DataAtom == atom.Img && isTrackingPixel(node) {
+			continue
+		}
+		p.rewriteNode(node)
+		if err := html.Render(&buf, node); err != nil {
+			return content
+		}
+	}
+	return buf.String()
+}
+
+func (p *Proxy) rewriteNode(node *html.Node) {
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type == html.ElementNode && child.DataAtom == atom.Img && isTrackingPixel(child) {
+			node.RemoveChild(child)
+		} else {
+			p.rewriteNode(child)
+		}
+		child = next
+	}
+
+	if node.Type != html.ElementNode {
+		return
+	}
+
+	for i, attr := range node.Attr {
+		switch {
+		case attr.Key == "src" && (node.DataAtom == atom.Img || node.DataAtom == atom.Source):
+			node.Attr[i].Val = p.URL(attr.Val)
+		case attr.Key == "poster" && node.DataAtom == atom.Video:
+			node.Attr[i].Val = p.URL(attr.Val)
+		case attr.Key == "srcset":
+			node.Attr[i].Val = p.rewriteSrcset(attr.Val)
+		}
+	}
+}
+
+func (p *Proxy) rewriteSrcset(srcset string) string {
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		fields[0] = p.URL(fields[0])
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+func isTrackingPixel(node *html.Node) bool {
+	var src, width, height string
+	for _, attr := range node.Attr {
+		switch attr.Key {
+		case "src":
+			src = attr.Val
+		case "width":
+			width = strings.TrimSpace(attr.Val)
+		case "height":
+			height = strings.TrimSpace(attr.Val)
+		}
+	}
+
+	if (width == "0" || width == "1") && (height == "0" || height == "1") {
+		return true
+	}
+
+	parsed, err := url.Parse(src)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	return trackerHosts[host] || strings.Contains(parsed.Path, "/~r/") || strings.Contains(parsed.Path, "/~ff/")
+}
+
+// Handle serves a signed image, from the disk cache when possible
+func (p *Proxy) Handle(c echo.Context) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(c.Param("url"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid image URL")
+	}
+	rawURL := string(decoded)
+
+	if !hmac.Equal([]byte(p.sign(rawURL)), []byte(c.Param("sig"))) {
+		return echo.NewHTTPError(http.StatusForbidden, errInvalidSignature.Error())
+	}
+
+	cachePath := filepath.Join(p.cacheDir, p.sign(rawURL)[:32])
+	meta, data, err := p.readCache(cachePath)
+	if err != nil {
+		meta, data, err = p.fetch(c.Request().Context(), rawURL)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+		}
+		p.writeCache(cachePath, meta, data)
+	}
+
+	header := c.Response().Header()
+	header.Set("Cache-Control", "public, max-age=604800, immutable")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	return c.Blob(http.StatusOK, meta.ContentType, data)
+}
+
+func (p *Proxy) fetch(ctx context.Context, rawURL string) (*cacheMeta, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.New("upstream returned " + resp.Status)
+	}
+	if resp.ContentLength > maxImageSize {
+		return nil, nil, errTooLarge
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, nil, errNotAnImage
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) > maxImageSize {
+		return nil, nil, errTooLarge
+	}
+
+	// Trust the bytes over the header, and never serve anything that is not
+	// a raster image from our origin
+	if sniffed := http.DetectContentType(data); strings.HasPrefix(sniffed, "image/") {
+		contentType = sniffed
+	} else if strings.Contains(contentType, "svg") || !strings.HasPrefix(contentType, "image/") {
+		return nil, nil, errNotAnImage
+	}
+
+	return &cacheMeta{ContentType: contentType, Expires: time.Now().Add(cacheDuration)}, data, nil
+}
+
+func (p *Proxy) readCache(path string) (*cacheMeta, []byte, error) {
+	metaBytes, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var meta cacheMeta
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return nil, nil, err
+	}
+	if time.Now().After(meta.Expires) {
+		return nil, nil, os.ErrNotExist
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &meta, data, nil
+}
+
+func (p *Proxy) writeCache(path string, meta *cacheMeta, data []byte) {
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		println("Error caching image:", err.Error())
+		return
+	}
+	if err := os.WriteFile(path+".json", metaBytes, 0o644); err != nil {
+		println("Error caching image:", err.Error())
+	}
+}
+
+// Prune deletes cached images that have expired
+func (p *Proxy) Prune() {
+	entries, err := os.ReadDir(p.cacheDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		metaPath := filepath.Join(p.cacheDir, entry.Name())
+		metaBytes, err := os.ReadFile(metaPath)
+		var meta cacheMeta
+		if err == nil && json.Unmarshal(metaBytes, &meta) == nil && time.Now().Before(meta.Expires) {
+			continue
+		}
+
+		_ = os.Remove(strings.TrimSuffix(metaPath, ".json"))
+		_ = os.Remove(metaPath)
+	}
+}
+
+// StartPruning prunes the cache periodically in the background
+func (p *Proxy) StartPruning(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			p.Prune()
+		}
+	}()
+}
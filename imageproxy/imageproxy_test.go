@@ -0,0 +1,218 @@
+package imageproxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newTestProxy(t *testing.T, client *http.Client) *Proxy {
+	t.Helper()
+	return &Proxy{key: []byte("test key"), cacheDir: t.TempDir(), client: client}
+}
+
+// serve calls Handle for a proxied path such as the one URL returns
+func serve(p *Proxy, path string) (*httptest.ResponseRecorder, error) {
+	e := echo.New()
+	recorder := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, path, nil), recorder)
+	parts := strings.SplitN(strings.TrimPrefix(path, "/img/"), "/", 2)
+	c.SetParamNames("sig", "url")
+	c.SetParamValues(parts[0], parts[1])
+	return recorder, p.Handle(c)
+}
+
+func statusOf(err error) int {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	return 0
+}
+
+func TestURL(t *testing.T) {
+	p := newTestProxy(t, nil)
+
+	tests := []struct {
+		input   string
+		proxied bool
+	}{
+		{"https://example.com/a.png", true},
+		{" http://example.com/a.png ", true},
+		{"/relative.png", false},
+		{"data:image/png;base64,AAAA", false},
+		{"javascript:alert(1)", false},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got := p.URL(test.input)
+			if proxied := strings.HasPrefix(got, "/img/"); proxied != test.proxied {
+				t.Fatalf("URL(%q) = %q, proxied %v", test.input, got, proxied)
+			}
+			if !test.proxied && got != strings.TrimSpace(test.input) {
+				t.Errorf("URL(%q) = %q, want it untouched", test.input, got)
+			}
+		})
+	}
+
+	if p.URL("https://example.com/a.png") == newTestProxy(t, nil).URL("https://example.com/b.png") {
+		t.Error("different images share a proxied URL")
+	}
+}
+
+func TestHandleRejectsBadSignatures(t *testing.T) {
+	p := newTestProxy(t, &http.Client{})
+	signed := p.URL("https://example.com/a.png")
+	other := base64.RawURLEncoding.EncodeToString([]byte("https://example.com/b.png"))
+	sig := strings.SplitN(strings.TrimPrefix(signed, "/img/"), "/", 2)[0]
+
+	tests := map[string]string{
+		"tampered URL":       "/img/" + sig + "/" + other,
+		"missing signature":  "/img/x/" + other,
+		"other key's digest": (&Proxy{key: []byte("other key")}).URL("https://example.com/b.png"),
+	}
+	for name, path := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := serve(p, path); statusOf(err) != http.StatusForbidden {
+				t.Errorf("err = %v, want 403", err)
+			}
+		})
+	}
+}
+
+func TestHandleRefusesPrivateAddresses(t *testing.T) {
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer server.Close()
+
+	p := newTestProxy(t, &http.Client{Transport: PublicTransport(), CheckRedirect: CheckRedirect})
+	for _, target := range []string{server.URL + "/a.png", "http://169.254.169.254/latest/meta-data/", "http://[::1]/a.png"} {
+		t.Run(target, func(t *testing.T) {
+			_, err := serve(p, p.URL(target))
+			if statusOf(err) != http.StatusBadGateway || !strings.Contains(err.Error(), ErrPrivateAddress.Error()) {
+				t.Errorf("err = %v, want the private address refused", err)
+			}
+		})
+	}
+	if requested {
+		t.Error("the local server was reached")
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	tests := []struct {
+		target string
+		ok     bool
+	}{
+		{"https://cdn.example.com/a.png", true},
+		{"http://93.184.216.34/a.png", true},
+		{"http://127.0.0.1/admin", false},
+		{"http://10.0.0.1/", false},
+		{"http://192.168.1.1/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://[::1]/", false},
+		{"http://[fe80::1]/", false},
+		{"http://0.0.0.0/", false},
+		{"http://localhost:8080/", false},
+		{"file:///etc/passwd", false},
+		{"gopher://example.com/", false},
+	}
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			target, _ := url.Parse(test.target)
+			err := CheckRedirect(&http.Request{URL: target}, nil)
+			if (err == nil) != test.ok {
+				t.Errorf("err = %v, want allowed %v", err, test.ok)
+			}
+		})
+	}
+
+	target, _ := url.Parse("https://example.com/")
+	if err := CheckRedirect(&http.Request{URL: target}, make([]*http.Request, 10)); err == nil {
+		t.Error("followed an eleventh redirect")
+	}
+}
+
+func TestHandleServesOnlyRasterImages(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(png))
+		case "/mislabelled.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("<html><script>alert(1)</script></html>"))
+		case "/vector.svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`))
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<p>not an image</p>"))
+		}
+	}))
+	defer server.Close()
+
+	// Reaching the local server needs a client without the address check
+	p := newTestProxy(t, &http.Client{})
+
+	recorder, err := serve(p, p.URL(server.URL+"/image.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Header().Get("Content-Type") != "image/png" || recorder.Body.String() != png {
+		t.Errorf("served %q as %q", recorder.Body.String(), recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Header().Get("Content-Security-Policy"), "sandbox") {
+		t.Error("image served without a sandboxing CSP")
+	}
+
+	// Formats the sniffer doesn't know keep their image type, and nosniff
+	// stops browsers reading them as anything else
+	recorder, err = serve(p, p.URL(server.URL+"/mislabelled.png"))
+	if err != nil || recorder.Header().Get("Content-Type") != "image/png" || recorder.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("mislabelled image served as %q, err = %v", recorder.Header().Get("Content-Type"), err)
+	}
+
+	for _, path := range []string{"/vector.svg", "/page.html"} {
+		t.Run(path, func(t *testing.T) {
+			if _, err := serve(p, p.URL(server.URL+path)); statusOf(err) != http.StatusBadGateway {
+				t.Errorf("err = %v, want it refused", err)
+			}
+		})
+	}
+}
+
+func TestRewriteHTML(t *testing.T) {
+	p := newTestProxy(t, nil)
+	image := "https://example.com/a.png"
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"proxies images", `<img src="` + image + `">`, `<img src="` + p.URL(image) + `"/>`},
+		{"proxies srcset candidates", `<img srcset="` + image + ` 2x">`, `<img srcset="` + p.URL(image) + ` 2x"/>`},
+		{"proxies video posters", `<video poster="` + image + `"></video>`, `<video poster="` + p.URL(image) + `"></video>`},
+		{"removes tracking pixels", `<p>Hi<img src="https://example.com/p.gif" width="1" height="1"></p>`, `<p>Hi</p>`},
+		{"removes tracker hosts", `<img src="https://pixel.wp.com/g.gif">`, ``},
+		{"leaves links alone", `<a href="` + image + `">a</a>`, `<a href="` + image + `">a</a>`},
+		{"leaves text alone", `plain text`, `plain text`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := p.RewriteHTML(test.input); got != test.want {
+				t.Errorf("RewriteHTML(%q) = %q, want %q", test.input, got, test.want)
+			}
+		})
+	}
+}
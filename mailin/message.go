@@ -0,0 +1,184 @@
+package mailin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	maxPartDepth = 10
+	// Inline images are stored in the article itself, so their total size
+	// is kept well under MongoDB's document limit
+	maxInlineBytes = 8 << 20
+)
+
+// Message is the part of an email that becomes an article
+type Message struct {
+	ID          string
+	Subject     string
+	From        string // The sender's display name, or address without one
+	FromAddress string
+	Date        time.Time
+	HTML        string // With cid: images inlined as data URIs
+	Text        string
+}
+
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: charset.NewReaderLabel,
+}
+
+// ParseMessage reads an RFC 5322 message, preferring the HTML body and
+// falling back to plain text
+func ParseMessage(r io.Reader) (*Message, error) {
+	raw, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %w", err)
+	}
+
+	message := &Message{
+		ID: strings.Trim(strings.TrimSpace(raw.Header.Get("Message-Id")), "<>"),
+	}
+	if subject, err := wordDecoder.DecodeHeader(raw.Header.Get("Subject")); err == nil {
+		message.Subject = strings.TrimSpace(subject)
+	} else {
+		message.Subject = raw.Header.Get("Subject")
+	}
+	if date, err := raw.Header.Date(); err == nil {
+		message.Date = date
+	}
+
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	if from, err := parser.Parse(raw.Header.Get("From")); err == nil {
+		message.FromAddress = from.Address
+		message.From = from.Name
+		if message.From == "" {
+			message.From = from.Address
+		}
+	}
+
+	body := &bodyParts{inline: make(map[string]string)}
+	if err := body.collect(textproto.MIMEHeader(raw.Header), raw.Body, 0); err != nil {
+		return nil, err
+	}
+	if body.html == "" && body.text == "" {
+		return nil, errors.New("message has no text or HTML body")
+	}
+
+	message.Text = body.text
+	message.HTML = body.inlineImages()
+	return message, nil
+}
+
+// bodyParts collects the first HTML and plain text parts of a message and
+// the images they reference by Content-ID
+type bodyParts struct {
+	html        string
+	text        string
+	inline      map[string]string
+	inlineBytes int
+}
+
+func (b *bodyParts) collect(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	if depth > maxPartDepth {
+		return errors.New("message is nested too deeply")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid multipart body: %w", err)
+			}
+			if err := b.collect(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	contentID := strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>")
+	decoded := decodeTransfer(body, header.Get("Content-Transfer-Encoding"))
+
+	switch {
+	case strings.HasPrefix(mediaType, "image/") && contentID != "":
+		data, err := io.ReadAll(io.LimitReader(decoded, maxInlineBytes+1))
+		if err != nil || b.inlineBytes+len(data) > maxInlineBytes || mediaType == "image/svg+xml" {
+			return nil
+		}
+		b.inlineBytes += len(data)
+		b.inline[contentID] = "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	case disposition == "attachment":
+		// Attached files aren't part of the newsletter itself
+	case mediaType == "text/html" && b.html == "":
+		b.html, err = readText(decoded, params["charset"])
+		return err
+	case mediaType == "text/plain" && b.text == "":
+		b.text, err = readText(decoded, params["charset"])
+		return err
+	}
+	return nil
+}
+
+// inlineImages points cid: references in the HTML body at the images
+// carried in the message
+func (b *bodyParts) inlineImages() string {
+	if b.html == "" || len(b.inline) == 0 {
+		return b.html
+	}
+	replacements := make([]string, 0, len(b.inline)*2)
+	for id, dataURI := range b.inline {
+		replacements = append(replacements, "cid:"+id, dataURI)
+	}
+	return strings.NewReplacer(replacements...).Replace(b.html)
+}
+
+func decodeTransfer(body io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+func readText(body io.Reader, charsetLabel string) (string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("invalid message body: %w", err)
+	}
+	if charsetLabel == "" {
+		return string(data), nil
+	}
+	reader, err := charset.NewReaderLabel(charsetLabel, bytes.NewReader(data))
+	if err != nil {
+		// Unknown charsets are read as they are rather than losing the body
+		return string(data), nil
+	}
+	text, err := io.ReadAll(reader)
+	if err != nil {
+		return string(data), nil
+	}
+	return string(text), nil
+}
@@ -0,0 +1,167 @@
+package mailin
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crlf turns a message written with \n line endings into wire format
+func crlf(message string) string {
+	return strings.ReplaceAll(message, "\n", "\r\n")
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		check   func(t *testing.T, message *Message)
+	}{
+		{
+			name: "plain text with headers",
+			message: `Message-ID: <abc@example.com>
+From: "Weekly Digest" <digest@example.com>
+Subject: =?UTF-8?Q?Caf=C3=A9_news?=
+Date: Tue, 05 Mar 2024 10:00:00 +0000
+Content-Type: text/plain; charset=utf-8
+
+Hello there
+`,
+			check: func(t *testing.T, message *Message) {
+				if message.ID != "abc@example.com" {
+					t.Errorf("ID = %q", message.ID)
+				}
+				if message.From != "Weekly Digest" || message.FromAddress != "digest@example.com" {
+					t.Errorf("from = %q <%s>", message.From, message.FromAddress)
+				}
+				if message.Subject != "Café news" {
+					t.Errorf("subject = %q, want it decoded", message.Subject)
+				}
+				if !message.Date.Equal(time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)) {
+					t.Errorf("date = %v", message.Date)
+				}
+				if message.Text != "Hello there\r\n" || message.HTML != "" {
+					t.Errorf("text = %q, html = %q", message.Text, message.HTML)
+				}
+			},
+		},
+		{
+			name: "alternative parts with transfer encodings",
+			message: `From: digest@example.com
+Subject: Issue 1
+Content-Type: multipart/alternative; boundary="b1"
+
+--b1
+Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+Caf=E9
+--b1
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: base64
+
+PHA+SGVsbG88L3A+
+--b1--
+`,
+			check: func(t *testing.T, message *Message) {
+				if message.From != "digest@example.com" {
+					t.Errorf("from = %q, want the address without a name", message.From)
+				}
+				if message.Text != "Café" {
+					t.Errorf("text = %q, want it decoded from Latin-1", message.Text)
+				}
+				if message.HTML != "<p>Hello</p>" {
+					t.Errorf("html = %q", message.HTML)
+				}
+			},
+		},
+		{
+			name: "inline images and attachments",
+			message: `From: digest@example.com
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/related; boundary="inner"
+
+--inner
+Content-Type: text/html
+
+<img src="cid:logo@example.com"><img src="cid:vector@example.com">
+--inner
+Content-Type: image/png
+Content-ID: <logo@example.com>
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgo=
+--inner
+Content-Type: image/svg+xml
+Content-ID: <vector@example.com>
+
+<svg onload="alert(1)"></svg>
+--inner--
+--outer
+Content-Type: text/plain
+Content-Disposition: attachment; filename="terms.txt"
+
+Not part of the newsletter
+--outer--
+`,
+			check: func(t *testing.T, message *Message) {
+				if !strings.Contains(message.HTML, `<img src="data:image/png;base64,iVBORw0KGgo=">`) {
+					t.Errorf("html = %q, want the PNG inlined", message.HTML)
+				}
+				if !strings.Contains(message.HTML, `cid:vector@example.com`) {
+					t.Errorf("html = %q, want the SVG left out", message.HTML)
+				}
+				if message.Text != "" {
+					t.Errorf("text = %q, want the attachment skipped", message.Text)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := ParseMessage(strings.NewReader(crlf(test.message)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, message)
+		})
+	}
+}
+
+// nestedMessage wraps a text part in depth levels of multipart bodies
+func nestedMessage(depth int) string {
+	var message strings.Builder
+	for i := 0; i < depth; i++ {
+		fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=b%d\n\n--b%d\n", i, i)
+	}
+	message.WriteString("Content-Type: text/plain\n\nx\n")
+	for i := depth - 1; i >= 0; i-- {
+		fmt.Fprintf(&message, "--b%d--\n", i)
+	}
+	return message.String()
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"no headers", "just text", "invalid message"},
+		{"only an attachment", "Content-Type: application/pdf\n\n%PDF", "no text or HTML body"},
+		{"nested too deeply", nestedMessage(maxPartDepth + 2), "nested too deeply"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseMessage(strings.NewReader(crlf(test.message)))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("err = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
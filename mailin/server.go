@@ -0,0 +1,292 @@
+package mailin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxSize = 25 << 20
+	maxRecipients  = 100
+	commandTimeout = 5 * time.Minute
+)
+
+// ErrUnknownRecipient is returned by a Backend for addresses it doesn't
+// accept mail for
+var ErrUnknownRecipient = errors.New("no such mailbox")
+
+// Backend decides which recipients mail is accepted for and stores what is
+// delivered to them. A message can be delivered to the same recipient more
+// than once, as SMTP senders retry every recipient of a transaction that
+// failed for any of them, so Deliver must file each message only once.
+type Backend interface {
+	Accept(recipient string) error
+	Deliver(recipient string, message *Message) error
+}
+
+// Server receives mail over SMTP, or over LMTP when it sits behind a mail
+// server that handles the internet-facing side. It only accepts mail for
+// recipients the Backend knows, so it can't be used as a relay.
+type Server struct {
+	Addr     string
+	Hostname string
+	LMTP     bool
+	MaxSize  int64
+	Backend  Backend
+}
+
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) maxSize() int64 {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return defaultMaxSize
+}
+
+// session is the state of one connection
+type session struct {
+	server     *Server
+	conn       net.Conn
+	text       *textproto.Conn
+	greeted    bool
+	hasSender  bool
+	recipients []string
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			println("Recovered from panic in mail session:", r)
+		}
+	}()
+
+	sess := &session{server: s, conn: conn, text: textproto.NewConn(conn)}
+	protocol := "ESMTP"
+	if s.LMTP {
+		protocol = "LMTP"
+	}
+	sess.reply(220, "%s %s RedReader ready", s.Hostname, protocol)
+
+	for {
+		conn.SetDeadline(time.Now().Add(commandTimeout))
+		line, err := sess.text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			if s.LMTP {
+				sess.reply(500, "5.5.1 Use LHLO")
+				continue
+			}
+			sess.greeted = true
+			sess.reset()
+			sess.reply(250, "%s", s.Hostname)
+		case "EHLO", "LHLO":
+			if s.LMTP != (strings.ToUpper(verb) == "LHLO") {
+				sess.reply(500, "5.5.1 Unknown command")
+				continue
+			}
+			sess.greeted = true
+			sess.reset()
+			sess.replyLines(250, s.Hostname, "8BITMIME", "ENHANCEDSTATUSCODES", "SIZE "+strconv.FormatInt(s.maxSize(), 10))
+		case "MAIL":
+			sess.mail(arg)
+		case "RCPT":
+			sess.rcpt(arg)
+		case "DATA":
+			sess.data()
+		case "RSET":
+			sess.reset()
+			sess.reply(250, "2.0.0 OK")
+		case "NOOP":
+			sess.reply(250, "2.0.0 OK")
+		case "VRFY":
+			sess.reply(252, "2.5.0 Cannot verify")
+		case "QUIT":
+			sess.reply(221, "2.0.0 Bye")
+			return
+		default:
+			sess.reply(502, "5.5.2 Command not implemented")
+		}
+	}
+}
+
+func (s *session) reply(code int, format string, args ...interface{}) {
+	s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (s *session) replyLines(code int, lines ...string) {
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		s.text.PrintfLine("%d%s%s", code, separator, line)
+	}
+}
+
+func (s *session) reset() {
+	s.hasSender = false
+	s.recipients = nil
+}
+
+func (s *session) mail(arg string) {
+	if !s.greeted {
+		s.reply(503, "5.5.1 Say hello first")
+		return
+	}
+	if s.hasSender {
+		s.reply(503, "5.5.1 Sender already given")
+		return
+	}
+	if _, params, ok := pathArgument(arg, "FROM:"); !ok {
+		s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	} else if size, err := strconv.ParseInt(params["SIZE"], 10, 64); err == nil && size > s.server.maxSize() {
+		s.reply(552, "5.3.4 Message too big")
+		return
+	}
+	s.hasSender = true
+	s.reply(250, "2.1.0 OK")
+}
+
+func (s *session) rcpt(arg string) {
+	if !s.hasSender {
+		s.reply(503, "5.5.1 Need MAIL first")
+		return
+	}
+	recipient, _, ok := pathArgument(arg, "TO:")
+	if !ok || recipient == "" {
+		s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(s.recipients) >= maxRecipients {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+
+	if err := s.server.Backend.Accept(recipient); err != nil {
+		if errors.Is(err, ErrUnknownRecipient) {
+			s.reply(550, "5.1.1 No such mailbox")
+		} else {
+			s.reply(451, "4.3.0 Temporary failure")
+		}
+		return
+	}
+	s.recipients = append(s.recipients, recipient)
+	s.reply(250, "2.1.5 OK")
+}
+
+func (s *session) data() {
+	if len(s.recipients) == 0 {
+		s.reply(503, "5.5.1 Need RCPT first")
+		return
+	}
+	s.reply(354, "End data with <CR><LF>.<CR><LF>")
+
+	s.conn.SetDeadline(time.Now().Add(commandTimeout))
+	reader := s.text.DotReader()
+	body, err := io.ReadAll(io.LimitReader(reader, s.server.maxSize()+1))
+	if err != nil {
+		return
+	}
+	recipients := s.recipients
+	s.reset()
+
+	// Every reply below is given once per recipient in LMTP and once in SMTP
+	if int64(len(body)) > s.server.maxSize() {
+		io.Copy(io.Discard, reader)
+		s.replyEach(recipients, func(string) (int, string) { return 552, "5.3.4 Message too big" })
+		return
+	}
+
+	message, err := ParseMessage(bytes.NewReader(body))
+	if err != nil {
+		s.replyEach(recipients, func(string) (int, string) { return 554, "5.6.0 " + err.Error() })
+		return
+	}
+
+	s.replyEach(recipients, func(recipient string) (int, string) {
+		if err := s.server.Backend.Deliver(recipient, message); err != nil {
+			println("Error delivering newsletter:", recipient, err.Error())
+			return 451, "4.3.0 Delivery failed"
+		}
+		return 250, "2.0.0 Delivered"
+	})
+}
+
+// replyEach delivers to every recipient, replying for each of them in LMTP.
+// SMTP has a single reply, which only reports success when every delivery
+// succeeded. Otherwise the sender retries the whole transaction, delivering
+// again to the recipients that already have it, which Backend.Deliver
+// ignores.
+func (s *session) replyEach(recipients []string, deliver func(recipient string) (int, string)) {
+	code, text := 250, "2.0.0 Delivered"
+	for _, recipient := range recipients {
+		recipientCode, recipientText := deliver(recipient)
+		if s.server.LMTP {
+			s.reply(recipientCode, "%s", recipientText)
+		} else if recipientCode != 250 {
+			code, text = recipientCode, recipientText
+		}
+	}
+	if !s.server.LMTP {
+		s.reply(code, "%s", text)
+	}
+}
+
+// pathArgument parses "FROM:<address> KEY=value ..." style arguments
+func pathArgument(arg, prefix string) (string, map[string]string, bool) {
+	arg = strings.TrimSpace(arg)
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	end := strings.Index(arg, ">")
+	if end < 0 {
+		return "", nil, false
+	}
+
+	params := make(map[string]string)
+	for _, param := range strings.Fields(arg[end+1:]) {
+		key, value, _ := strings.Cut(param, "=")
+		params[strings.ToUpper(key)] = value
+	}
+	return arg[1:end], params, true
+}
@@ -0,0 +1,152 @@
+package mailin
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeBackend accepts mail for the addresses in mailboxes, failing
+// deliveries to those in failing
+type fakeBackend struct {
+	mailboxes map[string]bool
+	failing   map[string]bool
+	delivered map[string][]*Message
+}
+
+func newFakeBackend(mailboxes ...string) *fakeBackend {
+	backend := &fakeBackend{
+		mailboxes: make(map[string]bool),
+		failing:   make(map[string]bool),
+		delivered: make(map[string][]*Message),
+	}
+	for _, mailbox := range mailboxes {
+		backend.mailboxes[mailbox] = true
+	}
+	return backend
+}
+
+func (b *fakeBackend) Accept(recipient string) error {
+	if !b.mailboxes[recipient] {
+		return ErrUnknownRecipient
+	}
+	return nil
+}
+
+func (b *fakeBackend) Deliver(recipient string, message *Message) error {
+	if b.failing[recipient] {
+		return errors.New("store unavailable")
+	}
+	b.delivered[recipient] = append(b.delivered[recipient], message)
+	return nil
+}
+
+// dial starts a session on server and returns the client's end, with the
+// greeting already read
+func dial(t *testing.T, server *Server) *textproto.Conn {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	go server.serve(serverConn)
+
+	client := textproto.NewConn(clientConn)
+	t.Cleanup(func() { client.Close() })
+	if _, _, err := client.ReadResponse(220); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+	return client
+}
+
+// send writes a command and checks the code of each reply to it
+func send(t *testing.T, client *textproto.Conn, command string, codes ...int) {
+	t.Helper()
+	if err := client.PrintfLine("%s", command); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range codes {
+		if got, message, err := client.ReadResponse(0); got != code {
+			t.Fatalf("%s: got %d %s (%v), want %d", command, got, message, err, code)
+		}
+	}
+}
+
+const testMessage = "From: digest@example.com\r\nSubject: Issue 1\r\n\r\nHello\r\n."
+
+func TestSMTPSession(t *testing.T) {
+	backend := newFakeBackend("news@mail.test")
+	client := dial(t, &Server{Hostname: "mail.test", Backend: backend})
+
+	send(t, client, "MAIL FROM:<digest@example.com>", 503)
+	send(t, client, "LHLO client.test", 500)
+	send(t, client, "EHLO client.test", 250)
+	send(t, client, "RCPT TO:<news@mail.test>", 503)
+	send(t, client, "MAIL FROM:<digest@example.com> SIZE=999999999", 552)
+	send(t, client, "MAIL FROM:<digest@example.com>", 250)
+	send(t, client, "MAIL FROM:<digest@example.com>", 503)
+	send(t, client, "RCPT TO:<relay@elsewhere.test>", 550)
+	send(t, client, "RCPT TO:news@mail.test", 501)
+	send(t, client, "RCPT TO:<news@mail.test>", 250)
+	send(t, client, "DATA", 354)
+	send(t, client, testMessage, 250)
+	send(t, client, "DATA", 503)
+	send(t, client, "QUIT", 221)
+
+	messages := backend.delivered["news@mail.test"]
+	if len(messages) != 1 || messages[0].Subject != "Issue 1" {
+		t.Errorf("delivered %+v, want the one message", messages)
+	}
+}
+
+func TestSMTPFailsTheTransactionForAnyRecipient(t *testing.T) {
+	backend := newFakeBackend("one@mail.test", "two@mail.test")
+	backend.failing["two@mail.test"] = true
+	client := dial(t, &Server{Hostname: "mail.test", Backend: backend})
+
+	send(t, client, "EHLO client.test", 250)
+	send(t, client, "MAIL FROM:<digest@example.com>", 250)
+	send(t, client, "RCPT TO:<one@mail.test>", 250)
+	send(t, client, "RCPT TO:<two@mail.test>", 250)
+	send(t, client, "DATA", 354)
+	// The sender retries both, so the backend sees one@ again
+	send(t, client, testMessage, 451)
+
+	if len(backend.delivered["one@mail.test"]) != 1 {
+		t.Errorf("one@ got %d deliveries, want 1", len(backend.delivered["one@mail.test"]))
+	}
+}
+
+func TestLMTPRepliesPerRecipient(t *testing.T) {
+	backend := newFakeBackend("one@mail.test", "two@mail.test")
+	backend.failing["two@mail.test"] = true
+	client := dial(t, &Server{Hostname: "mail.test", LMTP: true, Backend: backend})
+
+	send(t, client, "HELO client.test", 500)
+	send(t, client, "EHLO client.test", 500)
+	send(t, client, "LHLO client.test", 250)
+	send(t, client, "MAIL FROM:<digest@example.com>", 250)
+	send(t, client, "RCPT TO:<one@mail.test>", 250)
+	send(t, client, "RCPT TO:<two@mail.test>", 250)
+	send(t, client, "DATA", 354)
+	send(t, client, testMessage, 250, 451)
+}
+
+func TestSMTPRejectsOversizedAndInvalidMessages(t *testing.T) {
+	backend := newFakeBackend("news@mail.test")
+	client := dial(t, &Server{Hostname: "mail.test", MaxSize: 64, Backend: backend})
+
+	send(t, client, "EHLO client.test", 250)
+	send(t, client, "MAIL FROM:<digest@example.com>", 250)
+	send(t, client, "RCPT TO:<news@mail.test>", 250)
+	send(t, client, "DATA", 354)
+	send(t, client, "Subject: big\r\n\r\n"+strings.Repeat("x", 100)+"\r\n.", 552)
+
+	send(t, client, "MAIL FROM:<digest@example.com>", 250)
+	send(t, client, "RCPT TO:<news@mail.test>", 250)
+	send(t, client, "DATA", 354)
+	send(t, client, "Content-Type: application/pdf\r\n\r\n%PDF\r\n.", 554)
+
+	if len(backend.delivered) != 0 {
+		t.Errorf("delivered %v, want nothing", backend.delivered)
+	}
+}
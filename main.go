@@ -2,17 +2,26 @@ package main
 
 import (
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
 	"math"
+	neturl "net/url"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
+	"github.com/mmcdole/gofeed"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"redapplications.com/redreader/auth"
 	"redapplications.com/redreader/db"
+	"redapplications.com/redreader/imageproxy"
+	"redapplications.com/redreader/mailin"
 	"redapplications.com/redreader/middleware"
 	"redapplications.com/redreader/models"
 	"redapplications.com/redreader/repository"
@@ -83,11 +92,16 @@ func main() {
 
 	e := echo.New()
 
+	imageProxy := imageproxy.New()
+	imageProxy.StartPruning(time.Hour)
+
 	t := &Template{
 		templateFuncs: template.FuncMap{
-			"subtract": func(a, b int64) int64 { return a - b },
-			"add":      func(a, b int64) int64 { return a + b },
-			"safeHTML": func(s string) template.HTML { return template.HTML(s) },
+			"subtract":    func(a, b int64) int64 { return a - b },
+			"add":         func(a, b int64) int64 { return a + b },
+			"safeHTML":    func(s string) template.HTML { return template.HTML(s) },
+			"proxyImages": imageProxy.RewriteHTML,
+			"proxyURL":    imageProxy.URL,
 		},
 	}
 	e.Renderer = t
@@ -96,13 +110,44 @@ func main() {
 	userRepo := repository.NewUserRepository(mongoClient)
 	feedRepo := repository.NewFeedRepository(mongoClient)
 	articleRepo := repository.NewArticleRepository(mongoClient)
-	feedFetcher := worker.NewFeedFetcher(feedRepo, articleRepo)
+	fetchLogRepo := repository.NewFetchLogRepository(mongoClient)
+	playbackRepo := repository.NewPlaybackRepository(mongoClient)
+	newsletterRepo := repository.NewNewsletterRepository(mongoClient)
+	feedFetcher := worker.NewFeedFetcher(feedRepo, articleRepo, fetchLogRepo, userRepo)
+	webSub := worker.NewWebSubManager(feedRepo, feedFetcher)
+	hnThreads := worker.NewHackerNewsThreads()
+	inbox := worker.NewNewsletterInbox(newsletterRepo, articleRepo)
+
+	userRepo.CreateIndex()
+	feedRepo.CreateIndex()
+	articleRepo.CreateIndex()
+	fetchLogRepo.CreateIndex()
+	playbackRepo.CreateIndex()
+	newsletterRepo.CreateIndex()
+
+	migrator := worker.NewMigrator(repository.NewMigrationRepository(mongoClient), feedRepo, articleRepo)
+	if err := migrator.Run(); err != nil {
+		panic(err)
+	}
 
-	backgroundWorker := worker.NewBackgroundWorker(feedRepo, articleRepo)
+	backgroundWorker := worker.NewBackgroundWorker(feedFetcher, webSub)
 	backgroundWorker.Start()
 	defer backgroundWorker.Stop()
 
-	userRepo.CreateIndex()
+	// Newsletters arrive over SMTP, or LMTP from a local mail server
+	if addr := os.Getenv("MAIL_LISTEN_ADDR"); addr != "" && inbox.Enabled() {
+		mailServer := &mailin.Server{
+			Addr:     addr,
+			Hostname: inbox.Domain(),
+			LMTP:     strings.EqualFold(os.Getenv("MAIL_PROTOCOL"), "lmtp"),
+			Backend:  inbox,
+		}
+		go func() {
+			if err := mailServer.ListenAndServe(); err != nil {
+				println("Mail listener stopped:", err.Error())
+			}
+		}()
+	}
 
 	assets, err := fs.Sub(assetFs, "assets")
 	if err != nil {
@@ -110,10 +155,21 @@ func main() {
 	}
 
 	e.StaticFS("/assets", assets)
+	e.GET("/img/:sig/:url", imageProxy.Handle)
 
 	authMiddleware := middleware.NewAuthMiddleware(userRepo)
 	e.Pre(authMiddleware.AttachUser)
 
+	// Personal feeds, such as newsletters and GitHub feeds read with the
+	// owner's token, are only shown to their owner and subscribers
+	canRead := func(c echo.Context, feed *models.Feed) bool {
+		if feed.IsDefault {
+			return true
+		}
+		user, ok := c.Get("user").(*models.User)
+		return ok && user.CanRead(feed)
+	}
+
 	e.GET("/", func(c echo.Context) error {
 		data := map[string]interface{}{
 			"Title":    "Red Reader",
@@ -172,6 +228,9 @@ func main() {
 		if err != nil {
 			return err
 		}
+		if !canRead(c, feed) {
+			return echo.ErrNotFound
+		}
 
 		articles, total, err := articleRepo.GetPaginatedArticlesByFeed(feedId, page, perPage)
 		if err != nil {
@@ -190,16 +249,118 @@ func main() {
 		})
 	})
 
+	e.GET("/feeds/:id", func(c echo.Context) error {
+		feed, err := feedRepo.GetFeed(c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if !canRead(c, feed) {
+			return echo.ErrNotFound
+		}
+
+		fetchLogs, err := fetchLogRepo.GetRecentFetchLogs(feed.ID.Hex(), 50)
+		if err != nil {
+			return err
+		}
+
+		canManage := false
+		if user := c.Get("user"); user != nil {
+			canManage = user.(*models.User).OwnsFeed(feed.ID)
+		}
+
+		return c.Render(200, "feed_detail.html", map[string]interface{}{
+			"Title":     feed.Title,
+			"Feed":      feed,
+			"FetchLogs": fetchLogs,
+			"CanManage": canManage,
+			"Options":   feedFetcher.SourceOptions(feed),
+		})
+	})
+
+	// readableArticle loads an article for display, hiding those in feeds
+	// the visitor can't read
+	readableArticle := func(c echo.Context) (*repository.ArticleWithFeed, error) {
+		article, err := articleRepo.GetArticleContent(c.Param("id"))
+		if err != nil {
+			return nil, err
+		}
+		feed, err := feedRepo.GetFeed(article.FeedID)
+		if err != nil {
+			return nil, err
+		}
+		if !canRead(c, feed) {
+			return nil, echo.ErrNotFound
+		}
+		return article, nil
+	}
+
 	e.GET("/articles/:id/content", func(c echo.Context) error {
-		articleId := c.Param("id")
-		article, err := articleRepo.GetArticleContent(articleId)
+		article, err := readableArticle(c)
 		if err != nil {
 			return err
 		}
 		return c.Render(200, "article_modal.html", article)
 	})
 
-	e.GET("/articles", func(c echo.Context) error {
+	e.GET("/articles/:id/comments", func(c echo.Context) error {
+		article, err := readableArticle(c)
+		if err != nil {
+			return err
+		}
+		if article.HackerNewsID == 0 {
+			return echo.ErrNotFound
+		}
+
+		comments, err := hnThreads.Thread(c.Request().Context(), article.HackerNewsID)
+		if err != nil {
+			return c.String(200, "<p>Failed to load comments</p>")
+		}
+
+		return c.Render(200, "comments.html", map[string]interface{}{
+			"Comments":    comments,
+			"CommentsURL": article.CommentsURL,
+		})
+	})
+
+	e.GET("/articles/:id/playback", func(c echo.Context) error {
+		article, err := readableArticle(c)
+		if err != nil {
+			return err
+		}
+
+		var position float64
+		if user := c.Get("user"); user != nil {
+			position, err = playbackRepo.GetPosition(user.(*models.User).ID, article.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return c.JSON(200, map[string]interface{}{"position": position})
+	})
+
+	e.POST("/articles/:id/playback", func(c echo.Context) error {
+		user, ok := c.Get("user").(*models.User)
+		if !ok {
+			return echo.ErrUnauthorized
+		}
+
+		article, err := readableArticle(c)
+		if err != nil {
+			return err
+		}
+
+		position, err := strconv.ParseFloat(c.FormValue("position"), 64)
+		if err != nil || position < 0 {
+			return echo.NewHTTPError(400, "invalid playback position")
+		}
+
+		if err := playbackRepo.SavePosition(user.ID, article.ID, position); err != nil {
+			return err
+		}
+		return c.NoContent(204)
+	})
+
+	renderArticles := func(c echo.Context, tag string) error {
 		page, _ := strconv.ParseInt(c.QueryParam("page"), 10, 64)
 		if page < 1 {
 			page = 1
@@ -210,16 +371,32 @@ func main() {
 		var err error
 
 		user := c.Get("user")
+		var viewer *models.User
 		if user != nil {
-			articles, total, err = articleRepo.GetPaginatedArticlesForUser(user.(*models.User), page, perPage)
+			viewer = user.(*models.User)
+			articles, total, err = articleRepo.GetPaginatedArticlesForUser(viewer, tag, page, perPage)
 		} else {
-			articles, total, err = articleRepo.GetPaginatedArticles(page, perPage)
+			// Visitors only see the default feeds
+			var feedIds []string
+			feedIds, err = feedRepo.GetDefaultFeedIDs()
+			if err == nil {
+				articles, total, err = articleRepo.GetPaginatedArticles(feedIds, tag, page, perPage)
+			}
 		}
 
 		if err != nil {
 			return err
 		}
 
+		// Feeds filed under the tag as a whole are listed on its page
+		var tagFeeds []*models.Feed
+		if tag != "" {
+			tagFeeds, err = feedRepo.GetFeedsByCategory(viewer, tag)
+			if err != nil {
+				return err
+			}
+		}
+
 		pages, totalPages := calculatePages(total, perPage, page)
 
 		return c.Render(200, "articles.html", map[string]interface{}{
@@ -228,13 +405,59 @@ func main() {
 			"TotalPages":  totalPages,
 			"Pages":       pages,
 			"User":        user,
+			"Tag":         tag,
+			"TagFeeds":    tagFeeds,
 		})
+	}
+
+	e.GET("/articles", func(c echo.Context) error {
+		return renderArticles(c, models.NormalizeTag(c.QueryParam("tag")))
+	})
+
+	e.GET("/tags/:name", func(c echo.Context) error {
+		name, err := neturl.PathUnescape(c.Param("name"))
+		if err != nil {
+			return echo.ErrNotFound
+		}
+		tag := models.NormalizeTag(name)
+		if tag == "" {
+			return echo.ErrNotFound
+		}
+		return renderArticles(c, tag)
 	})
 
 	e.GET("/index", func(c echo.Context) error {
 		return c.Redirect(301, "/")
 	})
 
+	// WebSub hub callbacks
+	e.GET("/websub/:id", func(c echo.Context) error {
+		challenge, err := webSub.VerifyIntent(c.Param("id"), c.QueryParams())
+		if err != nil {
+			return c.NoContent(404)
+		}
+		return c.String(200, challenge)
+	})
+
+	e.POST("/websub/:id", func(c echo.Context) error {
+		body, err := io.ReadAll(io.LimitReader(c.Request().Body, 10<<20))
+		if err != nil {
+			return c.NoContent(400)
+		}
+
+		err = webSub.Receive(c.Param("id"), c.Request().Header.Get("X-Hub-Signature"), c.Request().Header.Get("Content-Type"), body)
+		if errors.Is(err, worker.ErrWebSubUnknownFeed) {
+			// Tells the hub to drop the subscription
+			return c.NoContent(410)
+		}
+		if err != nil && !errors.Is(err, worker.ErrWebSubInvalidSignature) {
+			println("Error receiving WebSub content:", err.Error())
+		}
+
+		// Hubs must get a 2xx even when the signature does not match
+		return c.NoContent(202)
+	})
+
 	e.GET("/login", auth.HandleGoogleLogin)
 	e.GET("/callback/google", func(c echo.Context) error {
 		return auth.HandleGoogleCallback(c, userRepo)
@@ -248,32 +471,164 @@ func main() {
 	})
 
 	e.GET("/article/:id", func(c echo.Context) error {
-		articleId := c.Param("id")
-		article, err := articleRepo.GetArticleContent(articleId)
+		article, err := readableArticle(c)
 		if err != nil {
 			return err
 		}
+		// Show the text extracted from the page unless the feed's own text
+		// was asked for
+		content := article.ViewContent()
+		source := "feed"
+		if article.ExtractedContent != "" && c.QueryParam("source") != "feed" {
+			content = article.ExtractedContent
+			source = "extracted"
+		}
+
 		return c.Render(200, "article_view.html", map[string]interface{}{
-			"Title":       article.Title,
-			"Author":      article.Author,
-			"PublishedAt": article.PublishedAt,
-			"FeedTitle":   article.FeedTitle,
-			"URL":         article.URL,
-			"ViewContent": article.ViewContent(),
+			"ID":                  article.ID,
+			"Title":               article.Title,
+			"Author":              article.Author,
+			"PublishedAt":         article.PublishedAt,
+			"FeedTitle":           article.FeedTitle,
+			"URL":                 article.URL,
+			"ViewContent":         content,
+			"ContentSource":       source,
+			"HasExtractedContent": article.ExtractedContent != "",
+			"Enclosures":          article.Enclosures,
+			"CommentsURL":         article.CommentsURL,
 		})
 	})
 
 	// Add subscribe/unsubscribe routes
+	e.GET("/settings", func(c echo.Context) error {
+		user, ok := c.Get("user").(*models.User)
+		if !ok {
+			return c.Redirect(302, "/login")
+		}
+
+		feeds, err := feedRepo.GetFeedsByIds(user.SubscribedTo)
+		if err != nil {
+			return err
+		}
+
+		return c.Render(200, "settings.html", map[string]interface{}{
+			"Title":          "Settings",
+			"Feeds":          feeds,
+			"HasGitHubToken": user.GitHubToken != "",
+		})
+	})
+
+	e.POST("/settings/github-token", func(c echo.Context) error {
+		user, ok := c.Get("user").(*models.User)
+		if !ok {
+			return echo.ErrUnauthorized
+		}
+
+		// An empty token removes the saved one
+		token := strings.TrimSpace(c.FormValue("token"))
+		if c.FormValue("remove") != "" {
+			token = ""
+		}
+		if err := userRepo.SetGitHubToken(user.ID, token); err != nil {
+			return err
+		}
+
+		return c.Redirect(303, "/settings")
+	})
+
+	renderNewsletters := func(c echo.Context, user *models.User, formError string) error {
+		addresses, err := newsletterRepo.GetAddressesForUser(user.ID)
+		if err != nil {
+			return err
+		}
+
+		return c.Render(200, "newsletters.html", map[string]interface{}{
+			"Title":     "Newsletters",
+			"Addresses": addresses,
+			"Domain":    inbox.Domain(),
+			"Enabled":   inbox.Enabled(),
+			"Error":     formError,
+		})
+	}
+
+	e.GET("/newsletters", func(c echo.Context) error {
+		user, ok := c.Get("user").(*models.User)
+		if !ok {
+			return c.Redirect(302, "/login")
+		}
+		return renderNewsletters(c, user, "")
+	})
+
+	e.POST("/newsletters", func(c echo.Context) error {
+		user, ok := c.Get("user").(*models.User)
+		if !ok {
+			return echo.ErrUnauthorized
+		}
+		if !inbox.Enabled() {
+			return renderNewsletters(c, user, "Mail delivery isn't set up on this server")
+		}
+
+		name := strings.TrimSpace(c.FormValue("name"))
+		if name == "" {
+			return renderNewsletters(c, user, "Give the newsletter a name")
+		}
+
+		// Each address delivers into a personal feed of its own
+		feed := models.NewFeed("")
+		feed.Kind = models.FeedKindNewsletter
+		feed.Title = name
+		address := models.NewNewsletterAddress(user.ID, feed.ID, name)
+		// The address is a secret, so it is only shown on the newsletters page
+		feed.URL = "newsletter:" + feed.ID.Hex()
+		feed.Description = models.NewsletterFeedDescription
+
+		if err := feedRepo.CreateFeed(feed); err != nil {
+			return err
+		}
+		if err := newsletterRepo.CreateAddress(address); err != nil {
+			_ = feedRepo.DeleteFeedByID(feed.ID)
+			return err
+		}
+		if err := userRepo.AddPersonalFeed(user.ID, feed.ID); err != nil {
+			return err
+		}
+		if err := userRepo.SubscribeToFeed(user.ID, feed.ID.Hex()); err != nil {
+			return err
+		}
+
+		return renderNewsletters(c, user, "")
+	})
+
+	e.POST("/newsletters/:id/revoke", func(c echo.Context) error {
+		user, ok := c.Get("user").(*models.User)
+		if !ok {
+			return echo.ErrUnauthorized
+		}
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			return echo.ErrNotFound
+		}
+
+		if err := newsletterRepo.Revoke(id, user.ID); err != nil {
+			return err
+		}
+		return renderNewsletters(c, user, "")
+	})
+
 	e.POST("/feeds/:id/subscribe", func(c echo.Context) error {
 		user := c.Get("user").(*models.User)
 		feedId := c.Param("id")
 
-		if err := userRepo.SubscribeToFeed(user.ID, feedId); err != nil {
+		// Subscribing grants access, so it is limited to feeds already visible
+		feed, err := feedRepo.GetFeed(feedId)
+		if err != nil {
 			return err
 		}
+		if !feed.IsDefault && !user.OwnsFeed(feed.ID) {
+			return echo.ErrNotFound
+		}
 
-		feed, err := feedRepo.GetFeed(feedId)
-		if err != nil {
+		if err := userRepo.SubscribeToFeed(user.ID, feedId); err != nil {
 			return err
 		}
 		feed.IsSubscribed = true
@@ -298,10 +653,194 @@ func main() {
 		return c.Render(200, "feed_card.html", feed)
 	})
 
+	e.POST("/feeds/:id/fetch", func(c echo.Context) error {
+		user := c.Get("user").(*models.User)
+		feed, err := feedRepo.GetFeed(c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if !user.OwnsFeed(feed.ID) {
+			return echo.ErrForbidden
+		}
+
+		// The outcome is recorded in the fetch log shown on the detail page
+		_ = feedFetcher.FetchOne(c.Request().Context(), feed)
+
+		return c.Redirect(303, "/feeds/"+feed.ID.Hex())
+	})
+
+	e.POST("/feeds/:id/fulltext", func(c echo.Context) error {
+		user := c.Get("user").(*models.User)
+		feed, err := feedRepo.GetFeed(c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if !user.OwnsFeed(feed.ID) {
+			return echo.ErrForbidden
+		}
+
+		if err := feedRepo.SetFetchFullContent(feed.ID, c.FormValue("enabled") == "true"); err != nil {
+			return err
+		}
+
+		return c.Redirect(303, "/feeds/"+feed.ID.Hex())
+	})
+
+	e.POST("/feeds/:id/options", func(c echo.Context) error {
+		user := c.Get("user").(*models.User)
+		feed, err := feedRepo.GetFeed(c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if !user.OwnsFeed(feed.ID) {
+			return echo.ErrForbidden
+		}
+
+		// Only settings the source understands are kept, alongside the ones
+		// it was created with
+		options := feed.Options
+		if options == nil {
+			options = make(map[string]string)
+		}
+		for _, option := range feedFetcher.SourceOptions(feed) {
+			if value := strings.TrimSpace(c.FormValue(option.Name)); value != "" {
+				options[option.Name] = value
+			} else {
+				delete(options, option.Name)
+			}
+		}
+
+		if err := feedRepo.UpdateOptions(feed.ID, options); err != nil {
+			return err
+		}
+		// Apply the new settings on the next fetch
+		feed.NextFetchAt = time.Time{}
+		if err := feedRepo.UpdateSchedule(feed); err != nil {
+			return err
+		}
+
+		return c.Redirect(303, "/feeds/"+feed.ID.Hex())
+	})
+
+	e.POST("/feeds/:id/url", func(c echo.Context) error {
+		user := c.Get("user").(*models.User)
+		feed, err := feedRepo.GetFeed(c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if !user.OwnsFeed(feed.ID) {
+			return echo.ErrForbidden
+		}
+
+		if feed.SourceKind() != models.FeedKindRSS {
+			return echo.NewHTTPError(400, "only RSS feeds have a URL to update")
+		}
+
+		url := c.FormValue("url")
+		if url == "" {
+			return echo.NewHTTPError(400, "missing feed URL")
+		}
+
+		if err := feedRepo.UpdateFeedURL(feed, url); err != nil {
+			return err
+		}
+		_ = feedFetcher.FetchOne(c.Request().Context(), feed)
+
+		return c.Redirect(303, "/feeds/"+feed.ID.Hex())
+	})
+
+	e.DELETE("/feeds/:id", func(c echo.Context) error {
+		user := c.Get("user").(*models.User)
+		feed, err := feedRepo.GetFeed(c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if !user.OwnsFeed(feed.ID) {
+			return echo.ErrForbidden
+		}
+
+		if err := userRepo.RemovePersonalFeed(user.ID, feed.ID); err != nil {
+			return err
+		}
+		if err := newsletterRepo.RevokeByFeed(feed.ID); err != nil {
+			return err
+		}
+		if err := feedRepo.DeleteFeedByID(feed.ID); err != nil {
+			return err
+		}
+		if err := articleRepo.DeleteArticlesByFeed(feed.ID.Hex()); err != nil {
+			return err
+		}
+		if err := fetchLogRepo.DeleteFetchLogsByFeed(feed.ID.Hex()); err != nil {
+			return err
+		}
+
+		c.Response().Header().Set("HX-Redirect", "/")
+		return c.NoContent(200)
+	})
+
+	e.POST("/feeds/preview", func(c echo.Context) error {
+		if _, ok := c.Get("user").(*models.User); !ok {
+			return echo.ErrUnauthorized
+		}
+		preview, err := worker.PreviewWebPage(c.Request().Context(), c.FormValue("url"), webPageOptions(c))
+		if err != nil {
+			return c.Render(200, "webpage_preview.html", map[string]interface{}{
+				"Error": err.Error(),
+			})
+		}
+		return c.Render(200, "webpage_preview.html", map[string]interface{}{
+			"Preview": preview,
+		})
+	})
+
 	e.POST("/feeds", func(c echo.Context) error {
 		user := c.Get("user").(*models.User)
 		url := c.FormValue("url")
 
+		// Addresses such as subreddits are fetched by their own source, and
+		// pages given selectors are watched rather than searched for feeds
+		var sourceFeed *models.Feed
+		var content *gofeed.Feed
+		var scraped *worker.WebPagePreview
+		var err error
+		if strings.TrimSpace(c.FormValue("item")) != "" {
+			sourceFeed, scraped, err = worker.NewWebPageFeed(c.Request().Context(), url, webPageOptions(c))
+		} else {
+			sourceFeed, err = worker.ResolveSourceFeed(c.Request().Context(), url, user)
+		}
+		if err != nil {
+			c.Response().Header().Set("HX-Reswap", "innerHTML")
+			c.Response().Header().Set("HX-Retarget", "#modal-error-message")
+			return c.String(200, "<p>"+template.HTMLEscapeString(err.Error())+"</p>")
+		}
+
+		if sourceFeed != nil {
+			url = sourceFeed.URL
+		} else {
+			// Resolve web pages to the feeds they advertise
+			discovered, err := worker.DiscoverFeeds(c.Request().Context(), url)
+			if err != nil {
+				c.Response().Header().Set("HX-Reswap", "innerHTML")
+				c.Response().Header().Set("HX-Retarget", "#modal-error-message")
+				return c.String(200, "<p>Failed to load URL</p>")
+			}
+			if len(discovered) == 0 {
+				c.Response().Header().Set("HX-Reswap", "innerHTML")
+				c.Response().Header().Set("HX-Retarget", "#modal-error-message")
+				return c.String(200, "<p>No feeds found at that URL</p>")
+			}
+			if len(discovered) > 1 {
+				c.Response().Header().Set("HX-Reswap", "innerHTML")
+				c.Response().Header().Set("HX-Retarget", "#modal-error-message")
+				return c.Render(200, "feed_choices.html", map[string]interface{}{
+					"Feeds": discovered,
+				})
+			}
+			url = discovered[0].URL
+			content = discovered[0].Feed
+		}
+
 		// Check if feed already exists for the user
 		exists, err := feedRepo.UserFeedExistsByURL(user, url)
 		if err != nil {
@@ -315,25 +854,48 @@ func main() {
 			return c.String(200, "<p>Feed already exists</p>")
 		}
 
-		feed, err := feedRepo.AddFeed(url)
+		feed := sourceFeed
+		if feed != nil {
+			err = feedRepo.CreateFeed(feed)
+		} else {
+			if content == nil {
+				content, err = worker.FetchFeed(c.Request().Context(), url)
+			}
+			if err != nil {
+				c.Response().Header().Set("HX-Reswap", "innerHTML")
+				c.Response().Header().Set("HX-Retarget", "#modal-error-message")
+				return c.String(200, "<p>Failed to read feed: "+template.HTMLEscapeString(err.Error())+"</p>")
+			}
+			feed, err = feedRepo.AddFeed(url, content)
+		}
 		if err != nil {
 			c.Response().Header().Set("HX-Reswap", "innerHTML")
 			c.Response().Header().Set("HX-Retarget", "#modal-error-message")
 			return c.String(200, "<p>Failed to add feed</p>")
 		}
 
-		if err = feedFetcher.FetchOne(feed); err != nil {
+		// Owned before the first fetch so sources can use the owner's tokens
+		if err := userRepo.AddPersonalFeed(user.ID, feed.ID); err != nil {
 			_ = feedRepo.DeleteFeedByID(feed.ID)
 			c.Response().Header().Set("HX-Reswap", "innerHTML")
 			c.Response().Header().Set("HX-Retarget", "#modal-error-message")
-			return c.String(200, "<p>Failed to fetch articles from feed.</p>")
+			return c.String(200, "<p>Failed to add personal feed</p>")
 		}
 
-		if err := userRepo.AddPersonalFeed(user.ID, feed.ID); err != nil {
+		// The document read while adding the feed is reused for its first fetch
+		if content != nil {
+			err = feedFetcher.FetchParsed(c.Request().Context(), feed, content)
+		} else if scraped != nil {
+			err = feedFetcher.FetchScraped(c.Request().Context(), feed, scraped)
+		} else {
+			err = feedFetcher.FetchOne(c.Request().Context(), feed)
+		}
+		if err != nil {
+			_ = userRepo.RemovePersonalFeed(user.ID, feed.ID)
 			_ = feedRepo.DeleteFeedByID(feed.ID)
 			c.Response().Header().Set("HX-Reswap", "innerHTML")
 			c.Response().Header().Set("HX-Retarget", "#modal-error-message")
-			return c.String(200, "<p>Failed to add personal feed</p>")
+			return c.String(200, "<p>Failed to fetch articles from feed: "+template.HTMLEscapeString(err.Error())+"</p>")
 		}
 
 		feeds, total, err := feedRepo.GetPaginatedFeeds(user, 1, 18)
@@ -354,6 +916,16 @@ func main() {
 	e.Logger.Fatal(e.Start(":1323"))
 }
 
+// webPageOptions reads the selectors for watching a page from the add feed form
+func webPageOptions(c echo.Context) map[string]string {
+	return map[string]string{
+		"item":  c.FormValue("item"),
+		"title": c.FormValue("title"),
+		"link":  c.FormValue("link"),
+		"date":  c.FormValue("date"),
+	}
+}
+
 func calculatePages(total int64, perPage int64, page int64) ([]int64, int64) {
 	totalPages := int64(math.Ceil(float64(total) / float64(perPage)))
 
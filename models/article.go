@@ -1,22 +1,34 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"redapplications.com/redreader/sanitize"
 )
 
 type Article struct {
-	ID          string    `json:"id" bson:"_id"`
-	FeedID      string    `json:"feedId" bson:"feedId"`
-	Title       string    `json:"title" bson:"title"`
-	Description string    `json:"description" bson:"description"`
-	Content     string    `json:"content" bson:"content"`
-	URL         string    `json:"url" bson:"url"`
-	Author      string    `json:"author" bson:"author"`
-	PublishedAt time.Time `json:"publishedAt" bson:"publishedAt"`
-	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
+	ID               string      `json:"id" bson:"_id"`
+	FeedID           string      `json:"feedId" bson:"feedId"`
+	Title            string      `json:"title" bson:"title"`
+	Description      string      `json:"description" bson:"description"`
+	Content          string      `json:"content" bson:"content"`
+	URL              string      `json:"url" bson:"url"`
+	Author           string      `json:"author" bson:"author"`
+	PublishedAt      time.Time   `json:"publishedAt" bson:"publishedAt"`
+	CreatedAt        time.Time   `json:"createdAt" bson:"createdAt"`
+	GUID             string      `json:"guid" bson:"guid"`
+	ContentHash      string      `json:"contentHash" bson:"contentHash"`
+	UpdatedAt        time.Time   `json:"updatedAt" bson:"updatedAt"`               // Set when a later fetch revised the article
+	ExtractedContent string      `json:"extractedContent" bson:"extractedContent"` // Main content pulled from the article's page
+	Enclosures       []Enclosure `json:"enclosures" bson:"enclosures,omitempty"`
+	ImageURL         string      `json:"imageUrl" bson:"imageUrl,omitempty"` // Lead image shown in the list views
+	Categories       []string    `json:"categories" bson:"categories,omitempty"`
+	CommentsURL      string      `json:"commentsUrl" bson:"commentsUrl,omitempty"` // Discussion page, for aggregators like Hacker News
+	HackerNewsID     int64       `json:"hackerNewsId" bson:"hackerNewsId,omitempty"`
 }
 
 const (
@@ -54,10 +66,16 @@ func (a *Article) TruncatedDescription() string {
 	if len(a.Description) <= maxDescriptionLength {
 		return a.Description
 	}
-	return strings.TrimSpace(a.Description[:297]) + "..."
+	// Cut on the text rather than the markup, so no tag is left open
+	return sanitize.Truncate(a.Description, 297)
 }
 
 func (a *Article) HasViewableContent() bool {
+	// Hacker News stories can always show their discussion
+	if a.ExtractedContent != "" || a.HasMedia() || a.HackerNewsID != 0 {
+		return true
+	}
+
 	if a.Content != "" && a.Content != a.Description {
 		return true
 	}
@@ -75,3 +93,42 @@ func (a *Article) ViewContent() string {
 	}
 	return a.Description
 }
+
+// ComputeContentHash hashes the fields that a feed may revise after an article
+// was first stored
+func (a *Article) ComputeContentHash() string {
+	hash := sha256.New()
+	for _, field := range []string{a.Title, a.Description, a.Content, a.URL, a.Author} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	// Only mixed in when present so articles without media keep their hash
+	for _, enclosure := range a.Enclosures {
+		hash.Write([]byte(enclosure.URL))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (a *Article) IsUpdated() bool {
+	return !a.UpdatedAt.IsZero()
+}
+
+// ReadableContent prefers the content extracted from the article's page over
+// what the feed provided
+func (a *Article) ReadableContent() string {
+	if a.ExtractedContent != "" {
+		return a.ExtractedContent
+	}
+	return a.ViewContent()
+}
+
+// HasMedia reports whether the article has audio or video to play
+func (a *Article) HasMedia() bool {
+	for _, enclosure := range a.Enclosures {
+		if enclosure.IsAudio() || enclosure.IsVideo() || enclosure.IsYouTube() {
+			return true
+		}
+	}
+	return false
+}
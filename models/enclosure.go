@@ -0,0 +1,81 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var youTubeIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{6,20}$`)
+
+// Enclosure is a media file attached to an article, such as a podcast episode
+type Enclosure struct {
+	URL      string `json:"url" bson:"url"`
+	Type     string `json:"type" bson:"type"`
+	Length   int64  `json:"length" bson:"length"`     // Size in bytes
+	Duration int    `json:"duration" bson:"duration"` // In seconds
+	Image    string `json:"image" bson:"image"`       // Episode artwork
+}
+
+func (e *Enclosure) IsAudio() bool {
+	return strings.HasPrefix(e.Type, "audio/")
+}
+
+// YouTubeVideoType marks enclosures that are YouTube videos, which are
+// embedded rather than played directly
+const YouTubeVideoType = "video/x-youtube"
+
+func (e *Enclosure) IsVideo() bool {
+	return strings.HasPrefix(e.Type, "video/") && !e.IsYouTube()
+}
+
+func (e *Enclosure) IsYouTube() bool {
+	return e.Type == YouTubeVideoType
+}
+
+// YouTubeID returns the ID of a YouTube video enclosure, from a watch,
+// youtu.be, embed or shorts link, or an empty string for anything else
+func (e *Enclosure) YouTubeID() string {
+	parsed, err := url.Parse(strings.TrimSpace(e.URL))
+	if err != nil {
+		return ""
+	}
+
+	var id string
+	host := strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+	segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	switch {
+	case host == "youtu.be":
+		id = segments[0]
+	case host == "youtube.com" || host == "m.youtube.com" || host == "youtube-nocookie.com":
+		if segments[0] == "watch" {
+			id = parsed.Query().Get("v")
+		} else if len(segments) == 2 && (segments[0] == "embed" || segments[0] == "shorts") {
+			id = segments[1]
+		}
+	}
+
+	// The ID ends up in an embed URL, so only the characters IDs use pass
+	if !youTubeIDPattern.MatchString(id) {
+		return ""
+	}
+	return id
+}
+
+func (e *Enclosure) IsImage() bool {
+	return strings.HasPrefix(e.Type, "image/")
+}
+
+func (e *Enclosure) FormattedDuration() string {
+	if e.Duration <= 0 {
+		return ""
+	}
+	hours := e.Duration / 3600
+	minutes := (e.Duration % 3600) / 60
+	seconds := e.Duration % 60
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
+	}
+	return fmt.Sprintf("%d:%02d", minutes, seconds)
+}
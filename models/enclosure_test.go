@@ -0,0 +1,32 @@
+package models
+
+import "testing"
+
+func TestYouTubeID(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=30s", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/watch?list=PL123&v=dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://m.youtube.com/watch?v=dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://youtu.be/dQw4w9WgXcQ?t=30", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/embed/dQw4w9WgXcQ?autoplay=1", "dQw4w9WgXcQ"},
+		{"https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/shorts/dQw4w9WgXcQ", "dQw4w9WgXcQ"},
+		{"https://www.youtube.com/watch?v=abc%22onload%3D", ""},
+		{"https://www.youtube.com/channel/UCabcdefghijk", ""},
+		{"https://example.com/watch?v=dQw4w9WgXcQ", ""},
+		{"not a url", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			enclosure := &Enclosure{URL: test.url, Type: YouTubeVideoType}
+			if got := enclosure.YouTubeID(); got != test.want {
+				t.Errorf("YouTubeID() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
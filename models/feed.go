@@ -7,20 +7,117 @@ import (
 )
 
 type Feed struct {
-	ID           primitive.ObjectID `json:"id" bson:"_id"`
-	URL          string             `json:"url" bson:"url"`
-	Title        string             `json:"title" bson:"title"`
-	Description  string             `json:"description" bson:"description"`
-	LastFetched  time.Time          `json:"lastFetched" bson:"lastFetched"`
-	IsSubscribed bool               `json:"isSubscribed" bson:"-"`
-	IsDefault    bool               `json:"isDefault" bson:"isDefault"`
+	ID                  primitive.ObjectID `json:"id" bson:"_id"`
+	URL                 string             `json:"url" bson:"url"`
+	Title               string             `json:"title" bson:"title"`
+	Description         string             `json:"description" bson:"description"`
+	LastFetched         time.Time          `json:"lastFetched" bson:"lastFetched"`
+	ETag                string             `json:"etag" bson:"etag"`
+	LastModified        string             `json:"lastModified" bson:"lastModified"`
+	NextFetchAt         time.Time          `json:"nextFetchAt" bson:"nextFetchAt"`
+	FetchInterval       time.Duration      `json:"fetchInterval" bson:"fetchInterval"` // Adapted to the feed's publishing cadence
+	ConsecutiveFailures int                `json:"consecutiveFailures" bson:"consecutiveFailures"`
+	LastError           string             `json:"lastError" bson:"lastError"`
+	Health              string             `json:"health" bson:"health"`
+	WebSub              WebSubSubscription `json:"webSub" bson:"webSub"`
+	FetchFullContent    bool               `json:"fetchFullContent" bson:"fetchFullContent"` // Download and extract each article's page
+	Categories          []string           `json:"categories" bson:"categories,omitempty"`
+	Kind                string             `json:"kind" bson:"kind,omitempty"`       // Which source fetches the feed, RSS when empty
+	Options             map[string]string  `json:"options" bson:"options,omitempty"` // Settings for the feed's source
+	IsSubscribed        bool               `json:"isSubscribed" bson:"-"`
+	IsDefault           bool               `json:"isDefault" bson:"isDefault"`
 }
 
+// WebSubSubscription tracks a push subscription to the hub a feed advertises
+type WebSubSubscription struct {
+	HubURL       string    `json:"hubUrl" bson:"hubUrl"`
+	Topic        string    `json:"topic" bson:"topic"`
+	Secret       string    `json:"-" bson:"secret"`
+	State        string    `json:"state" bson:"state"`
+	LeaseExpires time.Time `json:"leaseExpires" bson:"leaseExpires"`
+	RenewAt      time.Time `json:"renewAt" bson:"renewAt"`
+	// A subscribe request awaiting the hub's verification. Its secret only
+	// replaces Secret once the hub confirms it.
+	PendingSecret string    `json:"-" bson:"pendingSecret,omitempty"`
+	PendingUntil  time.Time `json:"pendingUntil" bson:"pendingUntil,omitempty"`
+}
+
+// AwaitingVerification reports whether we asked the hub to subscribe and
+// are still expecting it to verify the request
+func (s *WebSubSubscription) AwaitingVerification(now time.Time) bool {
+	return s.PendingSecret != "" && s.PendingUntil.After(now)
+}
+
+const (
+	WebSubStatePending    = "pending"
+	WebSubStateSubscribed = "subscribed"
+	WebSubStateFailed     = "failed"
+)
+
+// Active reports whether the hub is currently pushing updates for the feed
+func (s *WebSubSubscription) Active(now time.Time) bool {
+	return s.State == WebSubStateSubscribed && s.LeaseExpires.After(now)
+}
+
+const (
+	FeedKindRSS        = "rss"
+	FeedKindHackerNews = "hackernews"
+	FeedKindReddit     = "reddit"
+	FeedKindMastodon   = "mastodon"
+	FeedKindGitHub     = "github"
+	FeedKindNewsletter = "newsletter" // Delivered by mail rather than fetched
+	FeedKindWebPage    = "webpage"    // Scraped from a page without a feed
+)
+
+// SourceKind returns the kind of source that fetches the feed
+func (f *Feed) SourceKind() string {
+	if f.Kind == "" {
+		return FeedKindRSS
+	}
+	return f.Kind
+}
+
+const (
+	FeedHealthOK       = "ok"
+	FeedHealthDegraded = "degraded"
+	FeedHealthFailing  = "failing"
+	FeedHealthGone     = "gone"
+)
+
 func NewFeed(url string) *Feed {
 	return &Feed{
 		ID:          primitive.NewObjectID(),
 		URL:         url,
 		LastFetched: time.Time{},
 		IsDefault:   false,
+		Health:      FeedHealthOK,
+	}
+}
+
+func (f *Feed) HealthLabel() string {
+	switch f.Health {
+	case FeedHealthDegraded:
+		return "Degraded"
+	case FeedHealthFailing:
+		return "Failing"
+	case FeedHealthGone:
+		return "Gone"
+	default:
+		return "OK"
 	}
 }
+
+func (f *Feed) HealthClass() string {
+	switch f.Health {
+	case FeedHealthDegraded:
+		return "is-warning"
+	case FeedHealthFailing, FeedHealthGone:
+		return "is-danger"
+	default:
+		return "is-success"
+	}
+}
+
+func (f *Feed) IsHealthy() bool {
+	return f.Health == "" || f.Health == FeedHealthOK
+}
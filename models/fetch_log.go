@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FetchLog records the outcome of a single attempt to fetch a feed
+type FetchLog struct {
+	ID              primitive.ObjectID `json:"id" bson:"_id"`
+	FeedID          string             `json:"feedId" bson:"feedId"`
+	FetchedAt       time.Time          `json:"fetchedAt" bson:"fetchedAt"`
+	StatusCode      int                `json:"statusCode" bson:"statusCode"`
+	Duration        time.Duration      `json:"duration" bson:"duration"`
+	Bytes           int64              `json:"bytes" bson:"bytes"`
+	ItemCount       int                `json:"itemCount" bson:"itemCount"`
+	NewArticles     int                `json:"newArticles" bson:"newArticles"`
+	UpdatedArticles int                `json:"updatedArticles" bson:"updatedArticles"`
+	Error           string             `json:"error" bson:"error"`
+}
+
+func NewFetchLog(feedID string) *FetchLog {
+	return &FetchLog{
+		ID:        primitive.NewObjectID(),
+		FeedID:    feedID,
+		FetchedAt: time.Now(),
+	}
+}
+
+func (l *FetchLog) DurationMillis() int64 {
+	return l.Duration.Milliseconds()
+}
+
+func (l *FetchLog) NotModified() bool {
+	return l.StatusCode == 304
+}
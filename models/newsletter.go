@@ -0,0 +1,74 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewsletterAddress is a generated email address whose mail is delivered as
+// articles into a personal feed. Each newsletter gets its own address so a
+// leaked or abused one can be revoked on its own.
+type NewsletterAddress struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id"`
+	UserID         string             `json:"userId" bson:"userId"`
+	FeedID         primitive.ObjectID `json:"feedId" bson:"feedId"`
+	Name           string             `json:"name" bson:"name"`
+	LocalPart      string             `json:"localPart" bson:"localPart"` // The part before the @, unique across users
+	CreatedAt      time.Time          `json:"createdAt" bson:"createdAt"`
+	LastReceivedAt time.Time          `json:"lastReceivedAt" bson:"lastReceivedAt"`
+	Revoked        bool               `json:"revoked" bson:"revoked"`
+}
+
+// NewsletterFeedDescription describes newsletter feeds without giving away
+// their address, which is only shown to the owner on the newsletters page
+const NewsletterFeedDescription = "Newsletter delivered by email"
+
+var addressToken = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func NewNewsletterAddress(userID string, feedID primitive.ObjectID, name string) *NewsletterAddress {
+	return &NewsletterAddress{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		FeedID:    feedID,
+		Name:      name,
+		LocalPart: newsletterLocalPart(name),
+		CreatedAt: time.Now(),
+	}
+}
+
+// newsletterLocalPart combines a readable slug of the name with a random
+// token, so addresses can't be guessed from the newsletter's name
+func newsletterLocalPart(name string) string {
+	var slug strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			slug.WriteRune(r)
+		case slug.Len() > 0 && !strings.HasSuffix(slug.String(), "-"):
+			slug.WriteByte('-')
+		}
+		if slug.Len() >= 24 {
+			break
+		}
+	}
+
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+
+	prefix := strings.Trim(slug.String(), "-")
+	if prefix == "" {
+		prefix = "newsletter"
+	}
+	return prefix + "." + addressToken.EncodeToString(token)
+}
+
+// Address returns the full email address on the given mail domain
+func (a *NewsletterAddress) Address(domain string) string {
+	return a.LocalPart + "@" + domain
+}
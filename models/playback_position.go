@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// PlaybackPosition is how far a user got through an article's audio or video
+type PlaybackPosition struct {
+	UserID    string    `json:"userId" bson:"userId"`
+	ArticleID string    `json:"articleId" bson:"articleId"`
+	Position  float64   `json:"position" bson:"position"` // In seconds
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
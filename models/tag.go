@@ -0,0 +1,36 @@
+package models
+
+import "strings"
+
+const (
+	maxTagLength = 64
+	maxTags      = 20
+)
+
+// NormalizeTag folds a category name into the form tags are stored and
+// looked up in
+func NormalizeTag(name string) string {
+	tag := strings.ToLower(strings.Join(strings.Fields(name), " "))
+	if len(tag) > maxTagLength {
+		return ""
+	}
+	return tag
+}
+
+// NormalizeTags normalizes and de-duplicates a list of categories
+func NormalizeTags(names []string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		tag := NormalizeTag(name)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == maxTags {
+			break
+		}
+	}
+	return tags
+}
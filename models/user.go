@@ -12,6 +12,7 @@ type User struct {
 	Tokens        []string             `json:"tokens" bson:"tokens"`
 	SubscribedTo  []string             `json:"subscribedTo" bson:"subscribedTo"`   // Array of Feed IDs
 	PersonalFeeds []primitive.ObjectID `json:"personalFeeds" bson:"personalFeeds"` // Array of Feed IDs
+	GitHubToken   string               `json:"-" bson:"githubToken,omitempty"`     // Personal access token for GitHub feeds
 }
 
 func NewUser(email, name string) *User {
@@ -24,3 +25,28 @@ func NewUser(email, name string) *User {
 		PersonalFeeds: make([]primitive.ObjectID, 0),
 	}
 }
+
+func (u *User) OwnsFeed(feedID primitive.ObjectID) bool {
+	for _, id := range u.PersonalFeeds {
+		if id == feedID {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) IsSubscribed(feedID string) bool {
+	for _, id := range u.SubscribedTo {
+		if id == feedID {
+			return true
+		}
+	}
+	return false
+}
+
+// CanRead reports whether the user may see a feed and its articles. Default
+// feeds are public, personal feeds are only shown to their owner and
+// subscribers.
+func (u *User) CanRead(feed *Feed) bool {
+	return feed.IsDefault || u.OwnsFeed(feed.ID) || u.IsSubscribed(feed.ID.Hex())
+}
@@ -0,0 +1,171 @@
+package readability
+
+import (
+	"errors"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+var (
+	ErrNoContent = errors.New("readability: no article content found")
+
+	unlikelyCandidates = regexp.MustCompile(`(?i)banner|breadcrumb|combx|comment|community|cookie|disqus|extra|footer|gdpr|header|legends|menu|modal|nav|newsletter|pager|pagination|popup|promo|related|remark|replies|rss|share|shoutbox|sidebar|skyscraper|social|sponsor|subscribe|tags|tool|widget|ad-break|advert`)
+	maybeCandidate     = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow`)
+	positiveNames      = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|post|text|blog|story`)
+	negativeNames      = regexp.MustCompile(`(?i)-ad-|hidden|^hid$| hid$| hid |^hid |banner|combx|comment|com-|contact|foot|footer|footnote|gdpr|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget`)
+)
+
+const (
+	minParagraphLength = 25
+	minArticleLength   = 250
+)
+
+// Extract pulls the main article content out of a web page using a
+// readability-style heuristic: paragraphs are scored by their length and
+// punctuation, the scores flow up to their containers, and the best container
+// together with any related siblings is returned as HTML
+func Extract(page io.Reader) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(page)
+	if err != nil {
+		return "", err
+	}
+
+	doc.Find("script, style, noscript, iframe, form, nav, header, footer, aside, button, input, select, textarea, svg, link, meta").Remove()
+	doc.Find("*").Each(func(_ int, s *goquery.Selection) {
+		if goquery.NodeName(s) == "body" || goquery.NodeName(s) == "html" || goquery.NodeName(s) == "article" {
+			return
+		}
+		names := className(s)
+		if unlikelyCandidates.MatchString(names) && !maybeCandidate.MatchString(names) {
+			s.Remove()
+		}
+	})
+
+	scores := make(map[*html.Node]float64)
+	var candidates []*goquery.Selection
+
+	doc.Find("p, pre, td, blockquote").Each(func(_ int, p *goquery.Selection) {
+		text := strings.TrimSpace(p.Text())
+		if len(text) < minParagraphLength {
+			return
+		}
+
+		score := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text))/100, 3)
+
+		parent := p.Parent()
+		grandparent := parent.Parent()
+		for level, ancestor := range []*goquery.Selection{parent, grandparent} {
+			if ancestor.Length() == 0 || goquery.NodeName(ancestor) == "html" {
+				continue
+			}
+			node := ancestor.Get(0)
+			if _, seen := scores[node]; !seen {
+				scores[node] = initialScore(ancestor)
+				candidates = append(candidates, ancestor)
+			}
+			if level == 0 {
+				scores[node] += score
+			} else {
+				scores[node] += score / 2
+			}
+		}
+	})
+
+	var top *goquery.Selection
+	topScore := 0.0
+	for _, candidate := range candidates {
+		node := candidate.Get(0)
+		scores[node] *= 1 - linkDensity(candidate)
+		if top == nil || scores[node] > topScore {
+			top = candidate
+			topScore = scores[node]
+		}
+	}
+
+	if top == nil {
+		return "", ErrNoContent
+	}
+
+	// Pull in siblings that look like part of the same article, such as
+	// content split across several containers
+	threshold := math.Max(10, topScore*0.2)
+	var parts []string
+	textLength := 0
+	top.Parent().Children().Each(func(_ int, sibling *goquery.Selection) {
+		include := sibling.Get(0) == top.Get(0)
+		if !include {
+			if score, ok := scores[sibling.Get(0)]; ok && score >= threshold {
+				include = true
+			} else if goquery.NodeName(sibling) == "p" {
+				text := strings.TrimSpace(sibling.Text())
+				density := linkDensity(sibling)
+				include = (len(text) > 80 && density < 0.25) ||
+					(len(text) > 0 && density == 0 && strings.HasSuffix(text, "."))
+			}
+		}
+		if !include {
+			return
+		}
+
+		if part, err := goquery.OuterHtml(sibling); err == nil {
+			parts = append(parts, part)
+			textLength += len(strings.TrimSpace(sibling.Text()))
+		}
+	})
+
+	if textLength < minArticleLength {
+		return "", ErrNoContent
+	}
+
+	return strings.Join(parts, "\n"), nil
+}
+
+func initialScore(s *goquery.Selection) float64 {
+	score := 0.0
+	switch goquery.NodeName(s) {
+	case "article":
+		score += 10
+	case "div":
+		score += 5
+	case "pre", "td", "blockquote":
+		score += 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li", "form":
+		score -= 3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		score -= 5
+	}
+
+	names := className(s)
+	if negativeNames.MatchString(names) {
+		score -= 25
+	}
+	if positiveNames.MatchString(names) {
+		score += 25
+	}
+	if _, ok := s.Attr("itemprop"); ok && strings.Contains(s.AttrOr("itemprop", ""), "articleBody") {
+		score += 25
+	}
+	return score
+}
+
+func className(s *goquery.Selection) string {
+	return s.AttrOr("class", "") + " " + s.AttrOr("id", "")
+}
+
+func linkDensity(s *goquery.Selection) float64 {
+	textLength := len(strings.TrimSpace(s.Text()))
+	if textLength == 0 {
+		return 0
+	}
+
+	linkLength := 0
+	s.Find("a").Each(func(_ int, a *goquery.Selection) {
+		linkLength += len(strings.TrimSpace(a.Text()))
+	})
+	return float64(linkLength) / float64(textLength)
+}
@@ -24,6 +24,30 @@ func NewArticleRepository(client *mongo.Client) *ArticleRepository {
 	return &ArticleRepository{collection: collection}
 }
 
+func (r *ArticleRepository) CreateIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// Articles are identified by their GUID within a feed. Articles
+			// stored before GUIDs existed are left out of the constraint.
+			Keys: bson.D{{Key: "feedId", Value: 1}, {Key: "guid", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"guid": bson.M{"$gt": ""}}),
+		},
+		{
+			Keys: bson.D{{Key: "feedId", Value: 1}, {Key: "url", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "categories", Value: 1}, {Key: "publishedAt", Value: -1}},
+		},
+	})
+
+	return err
+}
+
 func (r *ArticleRepository) CreateArticle(article *models.Article) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -32,12 +56,170 @@ func (r *ArticleRepository) CreateArticle(article *models.Article) error {
 	return err
 }
 
-func (r *ArticleRepository) ArticleExists(url string) (bool, error) {
+// FindArticle returns the article a feed already stored for an item, or nil.
+// Articles stored before items had a GUID are matched on their URL.
+func (r *ArticleRepository) FindArticle(feedId string, guid string, url string) (*models.Article, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	count, err := r.collection.CountDocuments(ctx, bson.M{"url": url})
-	return count > 0, err
+	// Articles stored before GUIDs existed are matched on their link, but
+	// link-less ones have nothing to tell them apart
+	filter := bson.M{"feedId": feedId, "guid": guid}
+	if url != "" {
+		filter = bson.M{
+			"feedId": feedId,
+			"$or": []bson.M{
+				{"guid": guid},
+				{"url": url, "guid": bson.M{"$in": []interface{}{"", nil}}},
+			},
+		}
+	}
+
+	var article models.Article
+	err := r.collection.FindOne(ctx, filter).Decode(&article)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &article, nil
+}
+
+// FindArticleByGUID returns the article stored under guid in a feed, or nil
+func (r *ArticleRepository) FindArticleByGUID(feedId string, guid string) (*models.Article, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var article models.Article
+	err := r.collection.FindOne(ctx, bson.M{"feedId": feedId, "guid": guid}).Decode(&article)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &article, nil
+}
+
+// FindIdentifiedArticleByURL returns an article in a feed stored under url
+// that has a GUID, or nil
+func (r *ArticleRepository) FindIdentifiedArticleByURL(feedId string, url string) (*models.Article, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"feedId": feedId, "url": url, "guid": bson.M{"$nin": []interface{}{"", nil}}}
+	var article models.Article
+	err := r.collection.FindOne(ctx, filter).Decode(&article)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &article, nil
+}
+
+// SetIdentity replaces the URL and GUID an article is matched on
+func (r *ArticleRepository) SetIdentity(id string, url string, guid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"url": url, "guid": guid}},
+	)
+	return err
+}
+
+func (r *ArticleRepository) DeleteArticle(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (r *ArticleRepository) UpdateArticle(article *models.Article) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": article.ID},
+		bson.M{"$set": bson.M{
+			"title":        article.Title,
+			"description":  article.Description,
+			"content":      article.Content,
+			"url":          article.URL,
+			"author":       article.Author,
+			"enclosures":   article.Enclosures,
+			"imageUrl":     article.ImageURL,
+			"categories":   article.Categories,
+			"commentsUrl":  article.CommentsURL,
+			"hackerNewsId": article.HackerNewsID,
+			"guid":         article.GUID,
+			"contentHash":  article.ContentHash,
+			"updatedAt":    article.UpdatedAt,
+		}},
+	)
+	return err
+}
+
+func (r *ArticleRepository) UpdateExtractedContent(id string, content string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"extractedContent": content}},
+	)
+	return err
+}
+
+func (r *ArticleRepository) UpdateImageURL(id string, imageURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"imageUrl": imageURL}},
+	)
+	return err
+}
+
+// ForEachArticle calls fn for every stored article, stopping at the first error
+func (r *ArticleRepository) ForEachArticle(fn func(*models.Article) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	cursor, err := r.collection.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var article models.Article
+		if err := cursor.Decode(&article); err != nil {
+			return err
+		}
+		if err := fn(&article); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (r *ArticleRepository) DeleteArticlesByFeed(feedId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := r.collection.DeleteMany(ctx, bson.M{"feedId": feedId})
+	return err
 }
 
 func (r *ArticleRepository) GetPaginatedArticlesByFeed(feedId string, page, perPage int64) ([]*ArticleWithFeed, int64, error) {
@@ -71,18 +253,31 @@ func (r *ArticleRepository) GetPaginatedArticlesByFeed(feedId string, page, perP
 	return articles, total, nil
 }
 
-func (r *ArticleRepository) GetPaginatedArticles(page, perPage int64) ([]*ArticleWithFeed, int64, error) {
+// GetPaginatedArticles returns articles from the given default feeds, limited
+// to those carrying tag when it isn't empty
+func (r *ArticleRepository) GetPaginatedArticles(feedIds []string, tag string, page, perPage int64) ([]*ArticleWithFeed, int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	if len(feedIds) == 0 {
+		return []*ArticleWithFeed{}, 0, nil
+	}
+
 	skip := (page - 1) * perPage
+	filter := bson.M{"feedId": bson.M{"$in": feedIds}}
+	if tag != "" {
+		filter["categories"] = tag
+	}
 
-	total, err := r.collection.CountDocuments(ctx, bson.M{})
+	total, err := r.collection.CountDocuments(ctx, filter)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	pipeline := []bson.M{
+		{
+			"$match": filter,
+		},
 		{
 			"$sort": bson.M{"publishedAt": -1},
 		},
@@ -145,7 +340,7 @@ func (r *ArticleRepository) GetPaginatedArticles(page, perPage int64) ([]*Articl
 	return articles, total, nil
 }
 
-func (r *ArticleRepository) GetPaginatedArticlesForUser(user *models.User, page, perPage int64) ([]*ArticleWithFeed, int64, error) {
+func (r *ArticleRepository) GetPaginatedArticlesForUser(user *models.User, tag string, page, perPage int64) ([]*ArticleWithFeed, int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -155,13 +350,17 @@ func (r *ArticleRepository) GetPaginatedArticlesForUser(user *models.User, page,
 	}
 
 	skip := (page - 1) * perPage
-	matchStage := bson.M{
-		"$match": bson.M{
-			"feedId": bson.M{
-				"$in": user.SubscribedTo,
-			},
+	filter := bson.M{
+		"feedId": bson.M{
+			"$in": user.SubscribedTo,
 		},
 	}
+	if tag != "" {
+		filter["categories"] = tag
+	}
+	matchStage := bson.M{
+		"$match": filter,
+	}
 
 	// Count total matching documents
 	countPipeline := []bson.M{
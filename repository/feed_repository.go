@@ -3,7 +3,6 @@ package repository
 import (
 	"context"
 	"fmt"
-	"regexp"
 	"time"
 
 	"github.com/mmcdole/gofeed"
@@ -23,6 +22,17 @@ func NewFeedRepository(client *mongo.Client) *FeedRepository {
 	return &FeedRepository{collection: collection}
 }
 
+func (r *FeedRepository) CreateIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "categories", Value: 1}},
+	})
+
+	return err
+}
+
 func (r *FeedRepository) GetFeed(id string) (*models.Feed, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -61,6 +71,225 @@ func (r *FeedRepository) GetAllFeeds() ([]*models.Feed, error) {
 	return feeds, nil
 }
 
+// GetDueFeeds returns the feeds whose next scheduled fetch has passed,
+// including feeds that have never been scheduled
+func (r *FeedRepository) GetDueFeeds(now time.Time) ([]*models.Feed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"$or": []bson.M{
+			{"nextFetchAt": bson.M{"$lte": now}},
+			{"nextFetchAt": bson.M{"$exists": false}},
+		},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "nextFetchAt", Value: 1}})
+
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var feeds []*models.Feed
+	if err = cursor.All(ctx, &feeds); err != nil {
+		return nil, err
+	}
+	return feeds, nil
+}
+
+func (r *FeedRepository) UpdateSchedule(feed *models.Feed) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": feed.ID},
+		bson.M{"$set": bson.M{
+			"nextFetchAt":         feed.NextFetchAt,
+			"fetchInterval":       feed.FetchInterval,
+			"consecutiveFailures": feed.ConsecutiveFailures,
+			"lastError":           feed.LastError,
+			"health":              feed.Health,
+		}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (r *FeedRepository) SetFetchFullContent(id primitive.ObjectID, enabled bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"fetchFullContent": enabled}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (r *FeedRepository) UpdateOptions(id primitive.ObjectID, options map[string]string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"options": options}},
+	)
+	return err
+}
+
+func (r *FeedRepository) UpdateWebSub(feed *models.Feed) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": feed.ID},
+		bson.M{"$set": bson.M{"webSub": feed.WebSub}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// StartWebSubRequest saves a subscribe request before it is sent, so the
+// hub can verify it as soon as it receives it
+func (r *FeedRepository) StartWebSubRequest(feed *models.Feed) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": feed.ID},
+		bson.M{"$set": bson.M{
+			"webSub.pendingSecret": feed.WebSub.PendingSecret,
+			"webSub.pendingUntil":  feed.WebSub.PendingUntil,
+			"webSub.state":         feed.WebSub.State,
+			"webSub.renewAt":       feed.WebSub.RenewAt,
+		}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// FailWebSubRequest records that the hub turned down the subscribe request
+// signed with secret. A request the hub has already verified or denied is
+// left as the callback saved it.
+func (r *FeedRepository) FailWebSubRequest(id primitive.ObjectID, secret string, retryAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "webSub.pendingSecret": secret},
+		bson.M{
+			"$set": bson.M{
+				"webSub.state":   models.WebSubStateFailed,
+				"webSub.renewAt": retryAt,
+			},
+			"$unset": bson.M{"webSub.pendingSecret": "", "webSub.pendingUntil": ""},
+		},
+	)
+	return err
+}
+
+// GetWebSubFeedsDue returns feeds advertising a hub whose subscription needs
+// to be created, retried or renewed
+func (r *FeedRepository) GetWebSubFeedsDue(now time.Time) ([]*models.Feed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"webSub.hubUrl":  bson.M{"$nin": []interface{}{"", nil}},
+		"webSub.renewAt": bson.M{"$lte": now},
+	}
+
+	cursor, err := r.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var feeds []*models.Feed
+	if err = cursor.All(ctx, &feeds); err != nil {
+		return nil, err
+	}
+	return feeds, nil
+}
+
+func (r *FeedRepository) UpdateCategories(id primitive.ObjectID, categories []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"categories": categories}},
+	)
+	return err
+}
+
+// GetFeedsByCategory returns the feeds filed under tag that user can see,
+// only default feeds when user is nil
+func (r *FeedRepository) GetFeedsByCategory(user *models.User, tag string) ([]*models.Feed, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"categories": tag, "isDefault": true}
+	if user != nil {
+		filter = bson.M{
+			"categories": tag,
+			"$or": []bson.M{
+				{"_id": bson.M{"$in": user.PersonalFeeds}},
+				{"isDefault": true},
+			},
+		}
+	}
+
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(bson.M{"title": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var feeds []*models.Feed
+	if err = cursor.All(ctx, &feeds); err != nil {
+		return nil, err
+	}
+	return feeds, nil
+}
+
 func (r *FeedRepository) UpdateLastFetched(id string, lastFetchedTime time.Time) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -86,6 +315,69 @@ func (r *FeedRepository) UpdateLastFetched(id string, lastFetchedTime time.Time)
 	return nil
 }
 
+func (r *FeedRepository) UpdateCacheValidators(id string, etag, lastModified string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": objectID},
+		bson.M{"$set": bson.M{"etag": etag, "lastModified": lastModified}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// UpdateFeedURL points a feed at a new URL and clears everything learned from
+// the old one so it is fetched fresh
+func (r *FeedRepository) UpdateFeedURL(feed *models.Feed, url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	feed.URL = url
+	feed.ETag = ""
+	feed.LastModified = ""
+	feed.ConsecutiveFailures = 0
+	feed.LastError = ""
+	feed.Health = models.FeedHealthOK
+	feed.NextFetchAt = time.Time{}
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": feed.ID},
+		bson.M{"$set": bson.M{
+			"url":                 feed.URL,
+			"etag":                feed.ETag,
+			"lastModified":        feed.LastModified,
+			"consecutiveFailures": feed.ConsecutiveFailures,
+			"lastError":           feed.LastError,
+			"health":              feed.Health,
+			"nextFetchAt":         feed.NextFetchAt,
+		}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
 func (r *FeedRepository) GetPaginatedFeeds(user *models.User, page, perPage int64) ([]*models.Feed, int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -127,6 +419,30 @@ func (r *FeedRepository) GetPaginatedFeeds(user *models.User, page, perPage int6
 	return feeds, total, nil
 }
 
+// GetDefaultFeedIDs returns the IDs of the feeds everyone can read
+func (r *FeedRepository) GetDefaultFeedIDs() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := r.collection.Find(ctx, bson.M{"isDefault": true}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var ids []string
+	for cursor.Next(ctx) {
+		var feed struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.Decode(&feed); err != nil {
+			return nil, err
+		}
+		ids = append(ids, feed.ID.Hex())
+	}
+	return ids, cursor.Err()
+}
+
 func (r *FeedRepository) GetFeedsByIds(ids []string) ([]*models.Feed, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -153,22 +469,35 @@ func (r *FeedRepository) GetFeedsByIds(ids []string) ([]*models.Feed, error) {
 	return feeds, nil
 }
 
-func (r *FeedRepository) GetFeedByTitle(ctx context.Context, name string) (*models.Feed, error) {
-	filter := bson.M{"title": bson.M{"$regex": primitive.Regex{
-		Pattern: "^" + regexp.QuoteMeta(name) + "$",
-		Options: "i",
-	}}}
+// SetKindByURL sets the kind of the feeds stored under url, for feeds that
+// predate feed kinds and were marked by a placeholder URL
+func (r *FeedRepository) SetKindByURL(url string, kind string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	var feed models.Feed
-	err := r.collection.FindOne(ctx, filter).Decode(&feed)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("error finding feed by name: %v", err)
-	}
+	_, err := r.collection.UpdateMany(
+		ctx,
+		bson.M{"url": url, "kind": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"kind": kind}},
+	)
+	return err
+}
 
-	return &feed, nil
+// HideNewsletterAddresses replaces the mailto URL and description of
+// newsletter feeds, which used to carry their secret address
+func (r *FeedRepository) HideNewsletterAddresses() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateMany(
+		ctx,
+		bson.M{"kind": models.FeedKindNewsletter, "url": bson.M{"$regex": "^mailto:"}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"url":         bson.M{"$concat": bson.A{"newsletter:", bson.M{"$toString": "$_id"}}},
+			"description": models.NewsletterFeedDescription,
+		}}}},
+	)
+	return err
 }
 
 func (r *FeedRepository) AddSubscriptionStatus(feeds []*models.Feed, subscribedIds []string) {
@@ -182,7 +511,19 @@ func (r *FeedRepository) AddSubscriptionStatus(feeds []*models.Feed, subscribedI
 	}
 }
 
-func (r *FeedRepository) AddFeed(url string) (*models.Feed, error) {
+// CreateFeed stores a feed that was built by a source rather than parsed
+// from a document
+func (r *FeedRepository) CreateFeed(feed *models.Feed) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.InsertOne(ctx, feed)
+	return err
+}
+
+// AddFeed stores a new feed at url, taking its details from the already
+// parsed content
+func (r *FeedRepository) AddFeed(url string, content *gofeed.Feed) (*models.Feed, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -190,18 +531,14 @@ func (r *FeedRepository) AddFeed(url string) (*models.Feed, error) {
 		return nil, fmt.Errorf("invalid feed URL")
 	}
 
-	content, err := gofeed.NewParser().ParseURL(url)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing feed: %w", err)
-	}
-
 	feed := models.NewFeed(url)
 	feed.Title = content.Title
 	feed.Description = content.Description
+	feed.Categories = models.NormalizeTags(content.Categories)
 	feed.IsDefault = false
 	feed.URL = url
 
-	_, err = r.collection.InsertOne(ctx, feed)
+	_, err := r.collection.InsertOne(ctx, feed)
 	if err != nil {
 		return nil, err
 	}
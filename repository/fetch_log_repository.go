@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"redapplications.com/redreader/models"
+)
+
+const (
+	fetchLogRetention = 30 * 24 * time.Hour
+)
+
+type FetchLogRepository struct {
+	collection *mongo.Collection
+}
+
+func NewFetchLogRepository(client *mongo.Client) *FetchLogRepository {
+	collection := client.Database("redreader").Collection("fetch_logs")
+	return &FetchLogRepository{collection: collection}
+}
+
+func (r *FetchLogRepository) CreateIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "feedId", Value: 1}, {Key: "fetchedAt", Value: -1}},
+		},
+		{
+			Keys:    bson.D{{Key: "fetchedAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(fetchLogRetention.Seconds())),
+		},
+	})
+
+	return err
+}
+
+func (r *FetchLogRepository) CreateFetchLog(log *models.FetchLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.InsertOne(ctx, log)
+	return err
+}
+
+func (r *FetchLogRepository) GetRecentFetchLogs(feedId string, limit int64) ([]*models.FetchLog, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "fetchedAt", Value: -1}}).
+		SetLimit(limit)
+
+	cursor, err := r.collection.Find(ctx, bson.M{"feedId": feedId}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var logs []*models.FetchLog
+	if err = cursor.All(ctx, &logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+func (r *FetchLogRepository) DeleteFetchLogsByFeed(feedId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.DeleteMany(ctx, bson.M{"feedId": feedId})
+	return err
+}
@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MigrationRepository records which one-off data migrations have been applied
+type MigrationRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMigrationRepository(client *mongo.Client) *MigrationRepository {
+	collection := client.Database("redreader").Collection("migrations")
+	return &MigrationRepository{collection: collection}
+}
+
+func (r *MigrationRepository) IsApplied(name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	count, err := r.collection.CountDocuments(ctx, bson.M{"_id": name})
+	return count > 0, err
+}
+
+func (r *MigrationRepository) MarkApplied(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.InsertOne(ctx, bson.M{"_id": name, "appliedAt": time.Now()})
+	return err
+}
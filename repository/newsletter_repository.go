@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"redapplications.com/redreader/models"
+)
+
+type NewsletterRepository struct {
+	collection *mongo.Collection
+}
+
+func NewNewsletterRepository(client *mongo.Client) *NewsletterRepository {
+	collection := client.Database("redreader").Collection("newsletter_addresses")
+	return &NewsletterRepository{collection: collection}
+}
+
+func (r *NewsletterRepository) CreateIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "localPart", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+	})
+
+	return err
+}
+
+func (r *NewsletterRepository) CreateAddress(address *models.NewsletterAddress) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.InsertOne(ctx, address)
+	return err
+}
+
+// GetAddressByLocalPart returns the address mail to localPart is for, or nil
+// when there is none
+func (r *NewsletterRepository) GetAddressByLocalPart(localPart string) (*models.NewsletterAddress, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var address models.NewsletterAddress
+	err := r.collection.FindOne(ctx, bson.M{"localPart": localPart}).Decode(&address)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+func (r *NewsletterRepository) GetAddressesForUser(userId string) ([]*models.NewsletterAddress, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := r.collection.Find(ctx, bson.M{"userId": userId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var addresses []*models.NewsletterAddress
+	if err = cursor.All(ctx, &addresses); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// Revoke stops an address accepting mail. Articles already delivered stay
+// in its feed.
+func (r *NewsletterRepository) Revoke(id primitive.ObjectID, userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "userId": userId},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// RevokeByFeed revokes the addresses delivering to a feed that is removed
+func (r *NewsletterRepository) RevokeByFeed(feedId primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateMany(ctx, bson.M{"feedId": feedId}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+func (r *NewsletterRepository) UpdateLastReceived(id primitive.ObjectID, receivedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastReceivedAt": receivedAt}})
+	return err
+}
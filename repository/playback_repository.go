@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"redapplications.com/redreader/models"
+)
+
+type PlaybackRepository struct {
+	collection *mongo.Collection
+}
+
+func NewPlaybackRepository(client *mongo.Client) *PlaybackRepository {
+	collection := client.Database("redreader").Collection("playback_positions")
+	return &PlaybackRepository{collection: collection}
+}
+
+func (r *PlaybackRepository) CreateIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "articleId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	return err
+}
+
+// GetPosition returns where the user left off in an article's media, or zero
+func (r *PlaybackRepository) GetPosition(userId string, articleId string) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var position models.PlaybackPosition
+	err := r.collection.FindOne(ctx, bson.M{"userId": userId, "articleId": articleId}).Decode(&position)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return position.Position, nil
+}
+
+func (r *PlaybackRepository) SavePosition(userId string, articleId string, position float64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"userId": userId, "articleId": articleId},
+		bson.M{"$set": bson.M{"position": position, "updatedAt": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
@@ -32,6 +32,9 @@ func (r *UserRepository) CreateIndex() error {
 		{
 			Keys: bson.D{{Key: "tokens", Value: 1}},
 		},
+		{
+			Keys: bson.D{{Key: "personalFeeds", Value: 1}},
+		},
 	})
 
 	return err
@@ -147,3 +150,63 @@ func (r *UserRepository) AddPersonalFeed(userId string, feedId primitive.ObjectI
 
 	return nil
 }
+
+func (r *UserRepository) RemovePersonalFeed(userId string, feedId primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"id": userId},
+		bson.M{"$pull": bson.M{
+			"personalFeeds": feedId,
+			"subscribedTo":  feedId.Hex(),
+		}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// GetFeedOwner returns the user who added the feed, or nil for feeds nobody
+// owns such as the defaults
+func (r *UserRepository) GetFeedOwner(feedId primitive.ObjectID) (*models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user := &models.User{}
+	err := r.collection.FindOne(ctx, bson.M{"personalFeeds": feedId}).Decode(user)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *UserRepository) SetGitHubToken(userId string, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"id": userId},
+		bson.M{"$set": bson.M{"githubToken": token}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
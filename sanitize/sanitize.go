@@ -0,0 +1,360 @@
+package sanitize
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Elements that are kept as-is, along with the attributes each may carry on
+// top of globalAttrs
+var allowedElements = map[string][]string{
+	"a":          {"href"},
+	"abbr":       {},
+	"audio":      {"src", "controls", "preload"},
+	"b":          {},
+	"blockquote": {"cite"},
+	"br":         {},
+	"caption":    {},
+	"cite":       {},
+	"code":       {},
+	"col":        {"span"},
+	"colgroup":   {"span"},
+	"dd":         {},
+	"del":        {"cite", "datetime"},
+	"details":    {"open"},
+	"dfn":        {},
+	"div":        {},
+	"dl":         {},
+	"dt":         {},
+	"em":         {},
+	"figcaption": {},
+	"figure":     {},
+	"h1":         {},
+	"h2":         {},
+	"h3":         {},
+	"h4":         {},
+	"h5":         {},
+	"h6":         {},
+	"hr":         {},
+	"i":          {},
+	"img":        {"src", "srcset", "sizes", "width", "height", "loading"},
+	"ins":        {"cite", "datetime"},
+	"kbd":        {},
+	"li":         {"value"},
+	"mark":       {},
+	"ol":         {"start", "type", "reversed"},
+	"p":          {},
+	"picture":    {},
+	"pre":        {},
+	"q":          {"cite"},
+	"s":          {},
+	"samp":       {},
+	"small":      {},
+	"source":     {"src", "srcset", "sizes", "type", "media"},
+	"span":       {},
+	"strike":     {},
+	"strong":     {},
+	"sub":        {},
+	"summary":    {},
+	"sup":        {},
+	"table":      {},
+	"tbody":      {},
+	"td":         {"colspan", "rowspan", "align"},
+	"tfoot":      {},
+	"th":         {"colspan", "rowspan", "align", "scope"},
+	"thead":      {},
+	"time":       {"datetime"},
+	"tr":         {},
+	"track":      {"src", "kind", "srclang", "label"},
+	"u":          {},
+	"ul":         {},
+	"var":        {},
+	"video":      {"src", "controls", "poster", "preload", "width", "height"},
+}
+
+var globalAttrs = []string{"title", "alt", "lang", "dir"}
+
+// Elements removed together with everything inside them. Anything else that
+// is not allowed is unwrapped, keeping its children.
+var droppedElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"iframe":   true,
+	"frame":    true,
+	"frameset": true,
+	"object":   true,
+	"embed":    true,
+	"applet":   true,
+	"form":     true,
+	"input":    true,
+	"button":   true,
+	"textarea": true,
+	"select":   true,
+	"option":   true,
+	"noscript": true,
+	"template": true,
+	"svg":      true,
+	"math":     true,
+	"head":     true,
+	"title":    true,
+	"meta":     true,
+	"link":     true,
+	"base":     true,
+}
+
+var urlAttrs = map[string]bool{
+	"href":   true,
+	"src":    true,
+	"cite":   true,
+	"poster": true,
+}
+
+// HTML returns a copy of untrusted markup containing only allowlisted
+// elements and attributes, with scripts, event handlers and unsafe URLs
+// removed and every link opening in a new tab without an opener or referrer
+func HTML(input string) string {
+	if strings.TrimSpace(input) == "" {
+		return input
+	}
+
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(input), context)
+	if err != nil {
+		return html.EscapeString(input)
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		writeNode(&buf, node)
+	}
+	return buf.String()
+}
+
+// Text returns the plain text of untrusted markup, for fields such as titles
+// that are shown escaped rather than as HTML. Tags are dropped, entities
+// decoded once and runs of whitespace collapsed.
+func Text(input string) string {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(input), context)
+	if err != nil {
+		return strings.Join(strings.Fields(input), " ")
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		writeText(&buf, node)
+	}
+	return strings.Join(strings.Fields(buf.String()), " ")
+}
+
+// Truncate returns untrusted markup cut after limit characters of text,
+// ending in an ellipsis. Cuts never fall inside a tag or character, and the
+// result is sanitized like HTML with every element it cut into closed.
+func Truncate(input string, limit int) string {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(input), context)
+	if err != nil {
+		return html.EscapeString(input)
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		cut := truncateNode(node, &limit)
+		writeNode(&buf, node)
+		if cut {
+			break
+		}
+	}
+	return buf.String()
+}
+
+// truncateNode spends remaining on the text within node, reporting whether
+// it ran out. Whatever follows the cut is removed from the tree.
+func truncateNode(node *html.Node, remaining *int) bool {
+	if node.Type == html.TextNode {
+		text := []rune(node.Data)
+		if len(text) <= *remaining {
+			*remaining -= len(text)
+			return false
+		}
+		node.Data = strings.TrimRightFunc(string(text[:*remaining]), unicode.IsSpace) + "..."
+		*remaining = 0
+		return true
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if truncateNode(child, remaining) {
+			for child.NextSibling != nil {
+				node.RemoveChild(child.NextSibling)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func writeText(buf *bytes.Buffer, node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		buf.WriteString(node.Data)
+	case html.ElementNode:
+		if node.DataAtom == atom.Script || node.DataAtom == atom.Style {
+			return
+		}
+		if node.DataAtom == atom.Br {
+			buf.WriteString(" ")
+		}
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		writeText(buf, child)
+	}
+}
+
+func writeNode(buf *bytes.Buffer, node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		buf.WriteString(html.EscapeString(node.Data))
+		return
+	case html.ElementNode:
+	default:
+		// Comments, doctypes and anything else are dropped, but documents
+		// still have their children walked
+		if node.Type == html.DocumentNode {
+			writeChildren(buf, node)
+		}
+		return
+	}
+
+	name := strings.ToLower(node.Data)
+	if droppedElements[name] {
+		return
+	}
+
+	allowed, ok := allowedElements[name]
+	if !ok {
+		writeChildren(buf, node)
+		return
+	}
+
+	var attrs []html.Attribute
+	for _, attr := range node.Attr {
+		if attr.Namespace != "" {
+			continue
+		}
+		key := strings.ToLower(attr.Key)
+		if !contains(allowed, key) && !contains(globalAttrs, key) {
+			continue
+		}
+
+		value := attr.Val
+		switch {
+		case key == "srcset":
+			value = safeSrcset(value)
+		case urlAttrs[key]:
+			value = safeURL(value, name == "img" && key == "src")
+		}
+		if value == "" && key != "alt" && key != "controls" && key != "open" && key != "reversed" {
+			continue
+		}
+
+		attrs = append(attrs, html.Attribute{Key: key, Val: value})
+	}
+
+	if name == "a" {
+		attrs = append(attrs,
+			html.Attribute{Key: "target", Val: "_blank"},
+			html.Attribute{Key: "rel", Val: "noopener noreferrer"},
+		)
+	}
+
+	buf.WriteString("<" + name)
+	for _, attr := range attrs {
+		buf.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+	}
+	buf.WriteString(">")
+
+	if isVoid(name) {
+		return
+	}
+
+	writeChildren(buf, node)
+	buf.WriteString("</" + name + ">")
+}
+
+func writeChildren(buf *bytes.Buffer, node *html.Node) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		writeNode(buf, child)
+	}
+}
+
+// safeURL returns the URL if it is relative or uses a scheme that cannot run
+// script, otherwise an empty string. Inline data URIs are only allowed for
+// images.
+func safeURL(value string, allowDataImage bool) string {
+	value = strings.TrimSpace(value)
+	cleaned := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == ' ' {
+			return -1
+		}
+		return r
+	}, value)
+
+	lower := strings.ToLower(cleaned)
+	if allowDataImage && strings.HasPrefix(lower, "data:image/") && !strings.HasPrefix(lower, "data:image/svg") {
+		return value
+	}
+
+	parsed, err := url.Parse(cleaned)
+	if err != nil {
+		return ""
+	}
+
+	switch strings.ToLower(parsed.Scheme) {
+	case "", "http", "https", "mailto":
+		// A scheme-less value with a colon before any slash could be read as
+		// a scheme by browsers
+		if parsed.Scheme == "" && strings.Contains(strings.SplitN(cleaned, "/", 2)[0], ":") {
+			return ""
+		}
+		return value
+	default:
+		return ""
+	}
+}
+
+func safeSrcset(value string) string {
+	var candidates []string
+	for _, candidate := range strings.Split(value, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		if safeURL(fields[0], false) == "" {
+			continue
+		}
+		candidates = append(candidates, strings.Join(fields, " "))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+func isVoid(name string) bool {
+	switch name {
+	case "br", "col", "hr", "img", "source", "track":
+		return true
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
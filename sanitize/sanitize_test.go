@@ -0,0 +1,82 @@
+package sanitize
+
+import "testing"
+
+func TestHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"keeps allowed markup", `<p>Hello <em>there</em></p>`, `<p>Hello <em>there</em></p>`},
+		{"drops scripts with their content", `<p>a</p><script>alert(1)</script>`, `<p>a</p>`},
+		{"unwraps unknown elements", `<custom><b>bold</b></custom>`, `<b>bold</b>`},
+		{"strips event handlers", `<img src="https://example.com/a.png" onerror="alert(1)">`, `<img src="https://example.com/a.png">`},
+		{"strips javascript links", `<a href="javascript:alert(1)">x</a>`, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"strips obfuscated javascript links", "<a href=\"java\tscript:alert(1)\">x</a>", `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"opens links in a new tab", `<a href="https://example.com/">x</a>`, `<a href="https://example.com/" target="_blank" rel="noopener noreferrer">x</a>`},
+		{"allows data images", `<img src="data:image/png;base64,AAAA">`, `<img src="data:image/png;base64,AAAA">`},
+		{"rejects data SVG images", `<img src="data:image/svg+xml;base64,AAAA">`, `<img>`},
+		{"rejects data links", `<a href="data:text/html,hi">x</a>`, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"filters srcset candidates", `<img srcset="https://example.com/a.png 1x, javascript:alert(1) 2x">`, `<img srcset="https://example.com/a.png 1x">`},
+		{"drops style attributes", `<p style="position:fixed">x</p>`, `<p>x</p>`},
+		{"escapes text", `1 &lt; 2 &amp; 3`, `1 &lt; 2 &amp; 3`},
+		{"drops comments", `a<!-- <script>alert(1)</script> -->b`, `ab`},
+		{"closes unclosed tags", `<div><b>open`, `<div><b>open</b></div>`},
+		{"leaves blank input alone", "  ", "  "},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := HTML(test.input); got != test.want {
+				t.Errorf("HTML(%q) = %q, want %q", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"drops tags", `<b>Bold</b> title`, `Bold title`},
+		{"decodes entities once", `Tom &amp;amp; Jerry`, `Tom &amp; Jerry`},
+		{"decodes escaped markup to text", `&lt;img src=x onerror=alert(1)&gt;`, `<img src=x onerror=alert(1)>`},
+		{"drops script content", `Title<script>alert(1)</script>`, `Title`},
+		{"collapses whitespace", "  A\n\tB<br>C ", `A B C`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Text(test.input); got != test.want {
+				t.Errorf("Text(%q) = %q, want %q", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		limit int
+		want  string
+	}{
+		{"leaves short markup whole", `<p>Short</p>`, 10, `<p>Short</p>`},
+		{"closes the elements it cuts into", `<p>Hello <a href="https://example.com/">world wide</a> web</p>`, 11, `<p>Hello <a href="https://example.com/" target="_blank" rel="noopener noreferrer">world...</a></p>`},
+		{"never cuts inside a tag", `<div>abc</div><div>def</div>`, 4, `<div>abc</div><div>d...</div>`},
+		{"cuts between characters", `<p>naïve café</p>`, 3, `<p>naï...</p>`},
+		{"counts text rather than markup", `<p><b>a</b><i>b</i><u>c</u></p>`, 3, `<p><b>a</b><i>b</i><u>c</u></p>`},
+		{"sanitizes what it keeps", `<p onclick="x()">long enough text</p>`, 4, `<p>long...</p>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Truncate(test.input, test.limit); got != test.want {
+				t.Errorf("Truncate(%q, %d) = %q, want %q", test.input, test.limit, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package sanitize
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Attributes lazy-loading scripts use to hold the real image until it
+// scrolls into view, in order of preference
+var lazySrcAttrs = []string{"data-src", "data-lazy-src", "data-original", "data-lazy", "data-url", "data-hi-res-src"}
+var lazySrcsetAttrs = []string{"data-srcset", "data-lazy-srcset", "data-original-srcset"}
+
+// ResolveURLs rewrites relative links and image sources in markup against
+// baseURL, promotes lazy-loaded images to real src/srcset attributes and
+// normalises srcset lists, so the content renders correctly away from the
+// site it came from
+func ResolveURLs(input string, baseURL string) string {
+	if strings.TrimSpace(input) == "" {
+		return input
+	}
+
+	base, err := url.Parse(baseURL)
+	if err != nil || !base.IsAbs() {
+		base = nil
+	}
+
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(input), context)
+	if err != nil {
+		return input
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		rewriteNode(node, base)
+		if err := html.Render(&buf, node); err != nil {
+			return input
+		}
+	}
+	return buf.String()
+}
+
+func rewriteNode(node *html.Node, base *url.URL) {
+	if node.Type == html.ElementNode {
+		switch node.DataAtom {
+		case atom.Img, atom.Source:
+			promoteLazyAttrs(node)
+		}
+
+		for i, attr := range node.Attr {
+			switch attr.Key {
+			case "href", "src", "cite", "poster":
+				node.Attr[i].Val = resolve(attr.Val, base)
+			case "srcset":
+				node.Attr[i].Val = normalizeSrcset(attr.Val, base)
+			}
+		}
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		rewriteNode(child, base)
+	}
+}
+
+func promoteLazyAttrs(node *html.Node) {
+	if lazy := firstAttr(node, lazySrcAttrs); lazy != "" && isPlaceholder(getAttr(node, "src")) {
+		setAttr(node, "src", lazy)
+	}
+	if lazy := firstAttr(node, lazySrcsetAttrs); lazy != "" && getAttr(node, "srcset") == "" {
+		setAttr(node, "srcset", lazy)
+	}
+}
+
+// isPlaceholder reports whether an img src is missing or one of the tiny
+// stand-ins lazy loaders put there
+func isPlaceholder(src string) bool {
+	src = strings.ToLower(strings.TrimSpace(src))
+	return src == "" ||
+		strings.HasPrefix(src, "data:") ||
+		strings.Contains(src, "placeholder") ||
+		strings.Contains(src, "blank.gif") ||
+		strings.Contains(src, "spacer.gif") ||
+		strings.Contains(src, "lazy")
+}
+
+// normalizeSrcset resolves every candidate URL in a srcset and collapses the
+// whitespace around descriptors, dropping candidates with bad descriptors
+func normalizeSrcset(value string, base *url.URL) string {
+	var candidates []string
+	for _, candidate := range strings.Split(value, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 || len(fields) > 2 {
+			continue
+		}
+
+		normalized := resolve(fields[0], base)
+		if len(fields) == 2 {
+			descriptor := strings.ToLower(fields[1])
+			if !strings.HasSuffix(descriptor, "w") && !strings.HasSuffix(descriptor, "x") {
+				continue
+			}
+			normalized += " " + descriptor
+		}
+		candidates = append(candidates, normalized)
+	}
+	return strings.Join(candidates, ", ")
+}
+
+func resolve(value string, base *url.URL) string {
+	value = strings.TrimSpace(value)
+	if base == nil || value == "" || strings.HasPrefix(value, "#") {
+		return value
+	}
+
+	ref, err := url.Parse(value)
+	if err != nil || ref.IsAbs() {
+		return value
+	}
+	return base.ResolveReference(ref).String()
+}
+
+func firstAttr(node *html.Node, keys []string) string {
+	for _, key := range keys {
+		if value := strings.TrimSpace(getAttr(node, key)); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func getAttr(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(node *html.Node, key, value string) {
+	for i, attr := range node.Attr {
+		if attr.Key == key {
+			node.Attr[i].Val = value
+			return
+		}
+	}
+	node.Attr = append(node.Attr, html.Attribute{Key: key, Val: value})
+}
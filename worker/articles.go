@@ -0,0 +1,89 @@
+package worker
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"redapplications.com/redreader/models"
+	"redapplications.com/redreader/repository"
+	"redapplications.com/redreader/sanitize"
+)
+
+// sanitizeArticle strips anything unsafe from the HTML fields of an article
+// taken from a third party. Titles are stored as plain text.
+func sanitizeArticle(article *models.Article) {
+	article.Title = sanitize.Text(article.Title)
+	article.Description = sanitize.HTML(article.Description)
+	article.Content = sanitize.HTML(article.Content)
+}
+
+type upsertResult int
+
+const (
+	articleUnchanged upsertResult = iota
+	articleCreated
+	articleUpdated
+)
+
+// upsertArticle sanitizes and stores a freshly fetched article, or refreshes
+// the stored copy when the feed has revised it since. The article's GUID must
+// be set.
+func upsertArticle(articleRepo *repository.ArticleRepository, article *models.Article) (upsertResult, error) {
+	sanitizeArticle(article)
+	article.ContentHash = article.ComputeContentHash()
+
+	existing, err := articleRepo.FindArticle(article.FeedID, article.GUID, article.URL)
+	if err != nil {
+		return articleUnchanged, err
+	}
+
+	if existing == nil {
+		err := articleRepo.CreateArticle(article)
+		if mongo.IsDuplicateKeyError(err) {
+			// Stored concurrently, e.g. by a WebSub push during a poll
+			return articleUnchanged, nil
+		}
+		if err != nil {
+			return articleUnchanged, err
+		}
+		return articleCreated, nil
+	}
+
+	// Images and categories aren't part of the hash, but articles stored
+	// without them get them filled in once the feed provides them
+	backfill := (existing.ImageURL == "" && article.ImageURL != "") ||
+		(len(existing.Categories) == 0 && len(article.Categories) > 0)
+	if existing.ContentHash == article.ContentHash && existing.GUID == article.GUID && !backfill {
+		return articleUnchanged, nil
+	}
+
+	// Articles stored before hashing existed just get their hash filled in
+	// rather than being flagged as revised
+	revised := existing.ContentHash != "" && existing.ContentHash != article.ContentHash
+	if revised {
+		existing.UpdatedAt = time.Now()
+	}
+	existing.Title = article.Title
+	existing.Description = article.Description
+	existing.Content = article.Content
+	existing.URL = article.URL
+	existing.Author = article.Author
+	existing.Enclosures = article.Enclosures
+	if article.ImageURL != "" {
+		// Keep an image found on the article's page when the feed has none
+		existing.ImageURL = article.ImageURL
+	}
+	existing.Categories = article.Categories
+	existing.CommentsURL = article.CommentsURL
+	existing.HackerNewsID = article.HackerNewsID
+	existing.GUID = article.GUID
+	existing.ContentHash = article.ContentHash
+
+	if err := articleRepo.UpdateArticle(existing); err != nil {
+		return articleUnchanged, err
+	}
+	if revised {
+		return articleUpdated, nil
+	}
+	return articleUnchanged, nil
+}
@@ -1,30 +1,37 @@
 package worker
 
 import (
+	"context"
 	"time"
-
-	"redapplications.com/redreader/repository"
 )
 
 type BackgroundWorker struct {
-	fetcher   *FeedFetcher
-	hnFetcher *HackerNewsFetcher
-	ticker    *time.Ticker
-	done      chan bool
+	fetcher *FeedFetcher
+	webSub  *WebSubManager
+	ticker  *time.Ticker
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan bool
 }
 
-func NewBackgroundWorker(feedRepo *repository.FeedRepository, articleRepo *repository.ArticleRepository) *BackgroundWorker {
+// NewBackgroundWorker polls with the fetcher and WebSub manager the server
+// uses too, so they share one enrichment queue and one set of host limits
+func NewBackgroundWorker(fetcher *FeedFetcher, webSub *WebSubManager) *BackgroundWorker {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &BackgroundWorker{
-		fetcher:   NewFeedFetcher(feedRepo, articleRepo),
-		hnFetcher: NewHackerNewsFetcher(feedRepo, articleRepo),
-		ticker:    time.NewTicker(15 * time.Minute),
-		done:      make(chan bool),
+		fetcher: fetcher,
+		webSub:  webSub,
+		ticker:  time.NewTicker(time.Minute),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan bool),
 	}
 }
 
 func (w *BackgroundWorker) Start() {
 	println("Starting background worker...")
 	go func() {
+		defer close(w.done)
 		defer func() {
 			if r := recover(); r != nil {
 				println("Recovered from panic in background worker:", r)
@@ -35,7 +42,7 @@ func (w *BackgroundWorker) Start() {
 
 		for {
 			select {
-			case <-w.done:
+			case <-w.ctx.Done():
 				println("Background worker stopped")
 				return
 			case <-w.ticker.C:
@@ -52,18 +59,20 @@ func (w *BackgroundWorker) safeFetch() {
 		}
 	}()
 
-	// Fetch RSS feeds
-	if err := w.fetcher.FetchAll(); err != nil {
-		println("Error in feed fetching:", err)
+	// Fetch feeds of every kind that are due
+	if err := w.fetcher.FetchAll(w.ctx); err != nil {
+		println("Error in feed fetching:", err.Error())
 	}
 
-	// Fetch Hacker News stories
-	if err := w.hnFetcher.FetchAndSave(); err != nil {
-		println("Error in Hacker News fetching:", err)
+	// Subscribe to or renew WebSub hubs
+	if err := w.webSub.SubscribeDue(w.ctx); err != nil {
+		println("Error in WebSub subscribing:", err.Error())
 	}
 }
 
+// Stop cancels any fetches in flight and waits for the worker to exit
 func (w *BackgroundWorker) Stop() {
 	w.ticker.Stop()
-	w.done <- true
+	w.cancel()
+	<-w.done
 }
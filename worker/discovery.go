@@ -0,0 +1,229 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+	"redapplications.com/redreader/imageproxy"
+)
+
+const (
+	maxDiscoveryBodySize = 5 << 20
+)
+
+var errYouTubeChannelNotFound = errors.New("could not find the YouTube channel")
+
+// DiscoveredFeed is a feed found while looking at a web page
+type DiscoveredFeed struct {
+	URL   string
+	Title string
+	Type  string
+	Feed  *gofeed.Feed // The parsed feed, when it was downloaded while searching
+}
+
+var feedLinkTypes = map[string]string{
+	"application/rss+xml":   "RSS",
+	"application/atom+xml":  "Atom",
+	"application/feed+json": "JSON Feed",
+	"application/json":      "JSON Feed",
+	"application/rdf+xml":   "RSS",
+	"application/xml":       "RSS",
+	"text/xml":              "RSS",
+}
+
+var wellKnownFeedPaths = []string{
+	"/feed",
+	"/rss",
+	"/feed.xml",
+	"/rss.xml",
+	"/atom.xml",
+	"/index.xml",
+	"/feed.json",
+	"/?feed=rss2",
+}
+
+// DiscoverFeeds returns the feeds available at pageURL. If the URL is itself
+// a feed it is returned on its own, otherwise the page is searched for
+// <link rel="alternate"> tags before falling back to common feed paths.
+func DiscoverFeeds(ctx context.Context, pageURL string) ([]DiscoveredFeed, error) {
+	pageURL = strings.TrimSpace(pageURL)
+	if !strings.Contains(pageURL, "://") {
+		pageURL = "https://" + pageURL
+	}
+
+	base, err := url.Parse(pageURL)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid URL: %s", pageURL)
+	}
+
+	// YouTube pages don't reliably advertise their feed
+	if feedURL, ok, err := resolveYouTubeFeed(ctx, base); ok {
+		if err != nil {
+			return nil, err
+		}
+		pageURL = feedURL
+	}
+
+	body, finalURL, err := fetchDocument(ctx, pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsedFeed, err := parseFeed(body, ""); err == nil {
+		return []DiscoveredFeed{{URL: pageURL, Title: parsedFeed.Title, Type: feedTypeLabel(parsedFeed.FeedType), Feed: parsedFeed}}, nil
+	}
+
+	if finalURL != nil {
+		base = finalURL
+	}
+
+	feeds := feedLinksFromHTML(body, base)
+	if len(feeds) > 0 {
+		return feeds, nil
+	}
+
+	for _, path := range wellKnownFeedPaths {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		candidate, err := base.Parse(path)
+		if err != nil {
+			continue
+		}
+
+		body, _, err := fetchDocument(ctx, candidate.String())
+		if err != nil {
+			continue
+		}
+
+		if parsedFeed, err := parseFeed(body, ""); err == nil {
+			feeds = append(feeds, DiscoveredFeed{URL: candidate.String(), Title: parsedFeed.Title, Type: feedTypeLabel(parsedFeed.FeedType), Feed: parsedFeed})
+			break
+		}
+	}
+
+	return feeds, nil
+}
+
+// documentClient fetches pages at addresses given by users, and what they
+// link to, so it refuses to reach into our own network
+var documentClient = &http.Client{
+	Transport:     imageproxy.PublicTransport(),
+	CheckRedirect: imageproxy.CheckRedirect,
+}
+
+func fetchDocument(ctx context.Context, documentURL string) ([]byte, *url.URL, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, documentURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := documentClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, newFetchError(resp)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDiscoveryBodySize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return body, resp.Request.URL, nil
+}
+
+func feedLinksFromHTML(body []byte, base *url.URL) []DiscoveredFeed {
+	var feeds []DiscoveredFeed
+	seen := make(map[string]bool)
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return feeds
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+		if token.Data == "base" {
+			if href := attr(token, "href"); href != "" {
+				if resolved, err := base.Parse(href); err == nil {
+					base = resolved
+				}
+			}
+			continue
+		}
+		if token.Data == "body" {
+			return feeds
+		}
+		if token.Data != "link" || !hasRel(attr(token, "rel"), "alternate") {
+			continue
+		}
+
+		linkType, ok := feedLinkTypes[strings.ToLower(strings.TrimSpace(attr(token, "type")))]
+		href := attr(token, "href")
+		if !ok || href == "" {
+			continue
+		}
+
+		resolved, err := base.Parse(href)
+		if err != nil || seen[resolved.String()] {
+			continue
+		}
+		seen[resolved.String()] = true
+
+		feeds = append(feeds, DiscoveredFeed{
+			URL:   resolved.String(),
+			Title: attr(token, "title"),
+			Type:  linkType,
+		})
+	}
+}
+
+func attr(token html.Token, name string) string {
+	for _, a := range token.Attr {
+		if strings.EqualFold(a.Key, name) {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+	return ""
+}
+
+func hasRel(rel string, value string) bool {
+	for _, r := range strings.Fields(strings.ToLower(rel)) {
+		if r == value {
+			return true
+		}
+	}
+	return false
+}
+
+func feedTypeLabel(feedType string) string {
+	switch feedType {
+	case "atom":
+		return "Atom"
+	case "json":
+		return "JSON Feed"
+	default:
+		return "RSS"
+	}
+}
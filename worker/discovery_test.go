@@ -0,0 +1,44 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"redapplications.com/redreader/imageproxy"
+)
+
+func TestFetchDocumentRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<title>Router admin</title>"))
+	}))
+	defer server.Close()
+
+	tests := []string{
+		server.URL,
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/",
+	}
+	for _, pageURL := range tests {
+		t.Run(pageURL, func(t *testing.T) {
+			body, _, err := fetchDocument(context.Background(), pageURL)
+			if !errors.Is(err, imageproxy.ErrPrivateAddress) {
+				t.Errorf("body = %q, err = %v, want ErrPrivateAddress", body, err)
+			}
+		})
+	}
+}
+
+func TestPreviewWebPageRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<article><a href="/secret">Internal</a></article>`))
+	}))
+	defer server.Close()
+
+	preview, err := PreviewWebPage(context.Background(), server.URL, map[string]string{"item": "article"})
+	if !errors.Is(err, imageproxy.ErrPrivateAddress) {
+		t.Errorf("preview = %+v, err = %v, want ErrPrivateAddress", preview, err)
+	}
+}
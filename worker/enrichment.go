@@ -0,0 +1,45 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"redapplications.com/redreader/models"
+)
+
+const (
+	enrichmentQueueSize = 256
+	enrichmentWorkers   = 2
+	enrichmentTimeout   = 5 * time.Minute
+)
+
+// enrichmentJob is a batch of new articles whose web pages still need to be
+// read, kept off the fetch workers and request handlers that created them
+type enrichmentJob struct {
+	articles    []*models.Article
+	fullContent bool // Extract each page's content rather than just its image
+}
+
+// runEnrichments reads article pages queued by fetches until the process exits
+func (f *FeedFetcher) runEnrichments() {
+	for job := range f.enrichments {
+		ctx, cancel := context.WithTimeout(context.Background(), enrichmentTimeout)
+		if job.fullContent {
+			f.extractFullContent(ctx, job.articles)
+		} else {
+			f.fetchLeadImages(ctx, job.articles)
+		}
+		cancel()
+	}
+}
+
+// queueEnrichment hands articles to the enrichment workers. Page content is a
+// nicety, so a batch is dropped rather than holding up a fetch when the queue
+// is full.
+func (f *FeedFetcher) queueEnrichment(job enrichmentJob) {
+	select {
+	case f.enrichments <- job:
+	default:
+		println("Enrichment queue full, skipping", len(job.articles), "articles")
+	}
+}
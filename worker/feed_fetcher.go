@@ -1,103 +1,283 @@
 package worker
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/mmcdole/gofeed"
 	"redapplications.com/redreader/models"
 	"redapplications.com/redreader/repository"
+	"redapplications.com/redreader/sanitize"
 )
 
 type FeedFetcher struct {
-	feedRepo    *repository.FeedRepository
-	articleRepo *repository.ArticleRepository
-	parser      *gofeed.Parser
+	feedRepo     *repository.FeedRepository
+	articleRepo  *repository.ArticleRepository
+	fetchLogRepo *repository.FetchLogRepository
+	userRepo     *repository.UserRepository
+	client       *http.Client
+	sources      map[string]Source
+	enrichments  chan enrichmentJob
 }
 
-func NewFeedFetcher(feedRepo *repository.FeedRepository, articleRepo *repository.ArticleRepository) *FeedFetcher {
-	return &FeedFetcher{
-		feedRepo:    feedRepo,
-		articleRepo: articleRepo,
-		parser:      gofeed.NewParser(),
+const (
+	userAgent    = "RedReader/1.0 (+https://redapplications.com)"
+	fetchTimeout = 30 * time.Second
+)
+
+func NewFeedFetcher(feedRepo *repository.FeedRepository, articleRepo *repository.ArticleRepository, fetchLogRepo *repository.FetchLogRepository, userRepo *repository.UserRepository) *FeedFetcher {
+	f := &FeedFetcher{
+		feedRepo:     feedRepo,
+		articleRepo:  articleRepo,
+		fetchLogRepo: fetchLogRepo,
+		userRepo:     userRepo,
+		client:       &http.Client{},
+		sources:      make(map[string]Source),
+		enrichments:  make(chan enrichmentJob, enrichmentQueueSize),
+	}
+	for i := 0; i < enrichmentWorkers; i++ {
+		go f.runEnrichments()
 	}
+	f.RegisterSource(models.FeedKindRSS, &rssSource{fetcher: f})
+	f.RegisterSource(models.FeedKindHackerNews, newHackerNewsSource(articleRepo))
+	f.RegisterSource(models.FeedKindReddit, newRedditSource(articleRepo))
+	f.RegisterSource(models.FeedKindMastodon, newMastodonSource(articleRepo))
+	f.RegisterSource(models.FeedKindGitHub, newGitHubSource(feedRepo, articleRepo, userRepo))
+	f.RegisterSource(models.FeedKindWebPage, newWebPageSource(articleRepo))
+	f.RegisterSource(models.FeedKindNewsletter, newsletterSource{})
+	return f
 }
 
-func (f *FeedFetcher) FetchAll() error {
-	feeds, err := f.feedRepo.GetAllFeeds()
+// FetchAll fetches every feed that is due according to its schedule, returning
+// once they have all been attempted or the context is cancelled
+func (f *FeedFetcher) FetchAll(ctx context.Context) error {
+	due, err := f.feedRepo.GetDueFeeds(time.Now())
 	if err != nil {
 		return err
 	}
 
-	for _, feed := range feeds {
-		if feed.URL == "api" {
-			continue
+	var feeds []*models.Feed
+	for _, feed := range due {
+		if f.polled(feed) {
+			feeds = append(feeds, feed)
 		}
+	}
 
-		if err := f.FetchOne(feed); err != nil {
-			// Log error but continue with other feeds
-			println("Error fetching feed:", feed.Title, feed.URL, err)
-			continue
+	f.fetchConcurrently(ctx, feeds)
+	return ctx.Err()
+}
+
+// FetchOne fetches a single feed with the source for its kind, records the
+// attempt in the fetch log and schedules its next fetch based on the outcome
+func (f *FeedFetcher) FetchOne(ctx context.Context, feed *models.Feed) error {
+	source, err := f.source(feed)
+	return f.fetchWith(ctx, feed, source, err)
+}
+
+// FetchParsed records the first fetch of a feed whose document was already
+// downloaded and parsed while the feed was being added, rather than
+// downloading it again
+func (f *FeedFetcher) FetchParsed(ctx context.Context, feed *models.Feed, parsedFeed *gofeed.Feed) error {
+	return f.fetchWith(ctx, feed, &parsedSource{fetcher: f, parsedFeed: parsedFeed}, nil)
+}
+
+// FetchScraped records the first fetch of a watched page from the scrape
+// that checked its selectors when it was added
+func (f *FeedFetcher) FetchScraped(ctx context.Context, feed *models.Feed, page *WebPagePreview) error {
+	return f.fetchWith(ctx, feed, &scrapedSource{articleRepo: f.articleRepo, page: page}, nil)
+}
+
+func (f *FeedFetcher) fetchWith(ctx context.Context, feed *models.Feed, source Source, err error) error {
+	fetchCtx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	fetchLog := models.NewFetchLog(feed.ID.Hex())
+	var created []*models.Article
+	if err == nil {
+		created, err = source.Fetch(fetchCtx, feed, fetchLog)
+	}
+	if err != nil && ctx.Err() == context.Canceled {
+		// Shutting down, this attempt says nothing about the feed's health
+		return err
+	}
+
+	fetchLog.Duration = time.Since(fetchLog.FetchedAt)
+	if err != nil {
+		fetchLog.Error = err.Error()
+	} else {
+		// Recorded here so every source reports when it last succeeded
+		feed.LastFetched = time.Now()
+		if updateErr := f.feedRepo.UpdateLastFetched(feed.ID.Hex(), feed.LastFetched); updateErr != nil {
+			println("Error saving last fetched time:", feed.Title, updateErr.Error())
 		}
 	}
-	return nil
+
+	if scheduleErr := f.reschedule(feed, err); scheduleErr != nil {
+		println("Error scheduling feed:", feed.Title, scheduleErr.Error())
+	}
+	if logErr := f.fetchLogRepo.CreateFetchLog(fetchLog); logErr != nil {
+		println("Error saving fetch log:", feed.Title, logErr.Error())
+	}
+
+	f.enrichArticles(feed, created)
+	return err
+}
+
+// enrichArticles queues what new articles need from their web pages: the
+// full text for teaser feeds, and otherwise just a lead image. The pages are
+// read in the background so fetches and requests don't wait on them.
+func (f *FeedFetcher) enrichArticles(feed *models.Feed, articles []*models.Article) {
+	if len(articles) == 0 {
+		return
+	}
+	f.queueEnrichment(enrichmentJob{articles: articles, fullContent: feed.FetchFullContent})
 }
 
-func (f *FeedFetcher) FetchOne(feed *models.Feed) error {
-	parsedFeed, err := f.parser.ParseURL(feed.URL)
+func (f *FeedFetcher) fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.URL, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	// Send the validators from the last successful fetch so unchanged feeds
+	// come back as an empty 304 instead of the whole document
+	if feed.ETag != "" {
+		req.Header.Set("If-None-Match", feed.ETag)
+	}
+	if feed.LastModified != "" {
+		req.Header.Set("If-Modified-Since", feed.LastModified)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	fetchLog.StatusCode = resp.StatusCode
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, newFetchError(resp)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedSize))
+	fetchLog.Bytes = int64(len(body))
+	if err != nil {
+		return nil, err
+	}
+
+	parsedFeed, err := parseFeed(body, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := f.store(feed, parsedFeed, resp.Header, fetchLog)
+	if err != nil {
+		return created, err
 	}
 
+	// Only store the validators once every item has been saved, otherwise a
+	// failed run would be hidden behind a 304 on the next fetch
+	feed.ETag = resp.Header.Get("ETag")
+	feed.LastModified = resp.Header.Get("Last-Modified")
+
+	return created, f.feedRepo.UpdateCacheValidators(feed.ID.Hex(), feed.ETag, feed.LastModified)
+}
+
+// store updates the feed from a freshly parsed document and saves its items
+func (f *FeedFetcher) store(feed *models.Feed, parsedFeed *gofeed.Feed, header http.Header, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	fetchLog.ItemCount = len(parsedFeed.Items)
+
 	// Update feed metadata
 	feed.Title = parsedFeed.Title
 	feed.Description = parsedFeed.Description
-	feed.LastFetched = time.Now()
+	feed.FetchInterval = fetchInterval(parsedFeed)
+	feed.Categories = models.NormalizeTags(parsedFeed.Categories)
 
-	if err := f.feedRepo.UpdateLastFetched(feed.ID.Hex(), feed.LastFetched); err != nil {
-		return err
+	if err := f.feedRepo.UpdateCategories(feed.ID, feed.Categories); err != nil {
+		return nil, err
 	}
 
-	// Process items
+	f.updateHub(feed, parsedFeed, header)
+
+	created, updated, err := f.saveItems(feed, parsedFeed)
+	fetchLog.NewArticles = len(created)
+	fetchLog.UpdatedArticles = updated
+	return created, err
+}
+
+// saveItems stores the items of a parsed feed as articles, updating any the
+// feed has revised, and returns the newly created articles. It is shared by
+// polling and WebSub pushes.
+func (f *FeedFetcher) saveItems(feed *models.Feed, parsedFeed *gofeed.Feed) (created []*models.Article, updated int, err error) {
 	for _, item := range parsedFeed.Items {
 		if item == nil {
 			continue
 		}
 
-		// Skip if article already exists
-		exists, err := f.articleRepo.ArticleExists(item.Link)
-		if err != nil {
-			return err
-		}
-		if exists {
-			continue
-		}
-
 		article := models.NewArticle(feed.ID.Hex())
+		article.GUID = itemIdentity(item)
 		article.Title = item.Title
-		article.Description = item.Description
-		article.Content = item.Content
-		article.URL = item.Link
+
+		// Relative links in the content are relative to the item's page, or
+		// the feed's site when the item has no link
+		base := contentBaseURL(feed, parsedFeed, item)
+		if item.Link != "" {
+			article.URL = CanonicalizeURL(base)
+		}
+		article.Description = sanitize.ResolveURLs(item.Description, base)
+		article.Content = sanitize.ResolveURLs(item.Content, base)
+		if article.Content == "" && article.Description == "" {
+			article.Content = textToHTML(mediaDescription(item))
+		}
+		article.Enclosures = itemEnclosures(parsedFeed, item)
+		article.ImageURL = leadImage(parsedFeed, item, article)
+		article.Categories = models.NormalizeTags(item.Categories)
 		if len(item.Authors) > 0 {
 			article.Author = item.Authors[0].Name
 		} else {
 			article.Author = ""
 		}
 
-		if item.PublishedParsed != nil {
-			pubDate := *item.PublishedParsed
-			if pubDate.After(time.Now()) {
-				article.PublishedAt = time.Now()
-			} else {
-				article.PublishedAt = pubDate
-			}
-		} else {
-			article.PublishedAt = time.Now()
-		}
+		article.PublishedAt = itemPublished(item, time.Now())
 
-		if err := f.articleRepo.CreateArticle(article); err != nil {
-			return err
+		result, err := upsertArticle(f.articleRepo, article)
+		if err != nil {
+			return created, updated, err
+		}
+		switch result {
+		case articleCreated:
+			created = append(created, article)
+		case articleUpdated:
+			updated++
 		}
 	}
 
-	return nil
+	return created, updated, nil
+}
+
+func contentBaseURL(feed *models.Feed, parsedFeed *gofeed.Feed, item *gofeed.Item) string {
+	feedBase, err := url.Parse(feed.URL)
+	if err != nil {
+		return item.Link
+	}
+	if parsedFeed.Link != "" {
+		if siteURL, err := feedBase.Parse(parsedFeed.Link); err == nil {
+			feedBase = siteURL
+		}
+	}
+	if item.Link != "" {
+		if itemURL, err := feedBase.Parse(item.Link); err == nil {
+			return itemURL.String()
+		}
+	}
+	return feedBase.String()
 }
@@ -0,0 +1,132 @@
+package worker
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+
+	"redapplications.com/redreader/models"
+)
+
+const (
+	maxConcurrentFetches = 8
+	maxFetchesPerHost    = 2
+)
+
+// hostQueues hands out feeds so that no more than limit requests are in
+// flight against a single host, letting a large batch of feeds from one
+// publisher wait its turn without holding up workers that could fetch
+// other hosts in the meantime
+type hostQueues struct {
+	mu      sync.Mutex
+	wake    *sync.Cond
+	hosts   []string
+	pending map[string][]*models.Feed
+	active  map[string]int
+	next    int
+	limit   int
+	stopped bool
+}
+
+func newHostQueues(feeds []*models.Feed, limit int) *hostQueues {
+	q := &hostQueues{
+		pending: make(map[string][]*models.Feed),
+		active:  make(map[string]int),
+		limit:   limit,
+	}
+	q.wake = sync.NewCond(&q.mu)
+	for _, feed := range feeds {
+		host := feedHost(feed)
+		if _, ok := q.pending[host]; !ok {
+			q.hosts = append(q.hosts, host)
+		}
+		q.pending[host] = append(q.pending[host], feed)
+	}
+	return q
+}
+
+// take returns the next feed whose host has a free slot, waiting while
+// every host with feeds left is busy. It returns false once no feeds are
+// left or the queues are stopped.
+func (q *hostQueues) take() (*models.Feed, string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for !q.stopped {
+		waiting := false
+		// Start after the host served last so hosts take turns
+		for i := range q.hosts {
+			host := q.hosts[(q.next+i)%len(q.hosts)]
+			if len(q.pending[host]) == 0 {
+				continue
+			}
+			waiting = true
+			if q.active[host] >= q.limit {
+				continue
+			}
+
+			feed := q.pending[host][0]
+			q.pending[host] = q.pending[host][1:]
+			q.active[host]++
+			q.next = (q.next + i + 1) % len(q.hosts)
+			return feed, host, true
+		}
+		if !waiting {
+			return nil, "", false
+		}
+		q.wake.Wait()
+	}
+	return nil, "", false
+}
+
+func (q *hostQueues) done(host string) {
+	q.mu.Lock()
+	q.active[host]--
+	q.mu.Unlock()
+	q.wake.Broadcast()
+}
+
+func (q *hostQueues) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.mu.Unlock()
+	q.wake.Broadcast()
+}
+
+func feedHost(feed *models.Feed) string {
+	parsed, err := url.Parse(feed.URL)
+	if err != nil || parsed.Host == "" {
+		return feed.URL
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+// fetchConcurrently runs FetchOne over the feeds with a bounded number of
+// workers, stopping early when the context is cancelled
+func (f *FeedFetcher) fetchConcurrently(ctx context.Context, feeds []*models.Feed) {
+	queues := newHostQueues(feeds, maxFetchesPerHost)
+	stop := context.AfterFunc(ctx, queues.stop)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxConcurrentFetches; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				feed, host, ok := queues.take()
+				if !ok {
+					return
+				}
+
+				if err := f.FetchOne(ctx, feed); err != nil {
+					// Log error but continue with other feeds
+					println("Error fetching feed:", feed.Title, feed.URL, err.Error())
+				}
+				queues.done(host)
+			}
+		}()
+	}
+	wg.Wait()
+}
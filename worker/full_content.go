@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+
+	"redapplications.com/redreader/models"
+	"redapplications.com/redreader/readability"
+	"redapplications.com/redreader/sanitize"
+)
+
+const (
+	maxExtractionsPerFetch = 20
+)
+
+// extractFullContent downloads the page behind each article and stores the
+// main content found there, for feeds that only publish a teaser
+func (f *FeedFetcher) extractFullContent(ctx context.Context, articles []*models.Article) {
+	if len(articles) > maxExtractionsPerFetch {
+		articles = articles[:maxExtractionsPerFetch]
+	}
+
+	for _, article := range articles {
+		if ctx.Err() != nil {
+			return
+		}
+		if article.URL == "" {
+			continue
+		}
+
+		content, image, err := extractPage(ctx, article.URL)
+		if err != nil {
+			println("Error extracting article content:", article.URL, err.Error())
+			continue
+		}
+
+		if article.ImageURL == "" && image != "" {
+			article.ImageURL = image
+			if err := f.articleRepo.UpdateImageURL(article.ID, image); err != nil {
+				println("Error saving article image:", article.URL, err.Error())
+			}
+		}
+
+		article.ExtractedContent = content
+		if err := f.articleRepo.UpdateExtractedContent(article.ID, content); err != nil {
+			println("Error saving extracted content:", article.URL, err.Error())
+		}
+	}
+}
+
+// extractPage returns the main content of a page along with its sharing image
+func extractPage(ctx context.Context, pageURL string) (string, string, error) {
+	body, finalURL, err := fetchDocument(ctx, pageURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	content, err := readability.Extract(bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+
+	return sanitize.HTML(sanitize.ResolveURLs(content, finalURL.String())), pageImage(body, finalURL), nil
+}
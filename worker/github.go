@@ -0,0 +1,409 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"redapplications.com/redreader/models"
+	"redapplications.com/redreader/repository"
+)
+
+const (
+	githubURL           = "https://github.com"
+	githubAPIURL        = "https://api.github.com"
+	githubPageSize      = 30
+	githubMaxTagLookups = 20
+	githubFetchInterval = time.Hour
+
+	githubModeReleases = "releases"
+	githubModeTags     = "tags"
+	githubModeCommits  = "commits"
+)
+
+// Owners can't contain dots, which keeps "example.com/feed" from matching
+var githubRepoName = regexp.MustCompile(`^([A-Za-z0-9-]+)/([A-Za-z0-9_.-]+)$`)
+
+// githubSource follows the releases, tags or commits of a repository
+// through the GitHub API, authenticating with the feed owner's personal
+// token when they have set one
+type githubSource struct {
+	feedRepo    *repository.FeedRepository
+	articleRepo *repository.ArticleRepository
+	userRepo    *repository.UserRepository
+	apiURL      string
+}
+
+func newGitHubSource(feedRepo *repository.FeedRepository, articleRepo *repository.ArticleRepository, userRepo *repository.UserRepository) *githubSource {
+	return &githubSource{feedRepo: feedRepo, articleRepo: articleRepo, userRepo: userRepo, apiURL: githubAPIURL}
+}
+
+func (s *githubSource) Options() []SourceOption {
+	return []SourceOption{
+		{Name: "mode", Label: "Follow", Help: "releases, tags or commits"},
+		{Name: "branch", Label: "Branch", Help: "For commits, the repository's default branch when empty"},
+		{Name: "prereleases", Label: "Pre-releases", Help: "no to skip pre-releases"},
+	}
+}
+
+type githubRelease struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	TagName     string    `json:"tag_name"`
+	HTMLURL     string    `json:"html_url"`
+	BodyHTML    string    `json:"body_html"`
+	Draft       bool      `json:"draft"`
+	Prerelease  bool      `json:"prerelease"`
+	PublishedAt time.Time `json:"published_at"`
+	Author      struct {
+		Login string `json:"login"`
+	} `json:"author"`
+}
+
+type githubTag struct {
+	Name   string `json:"name"`
+	Commit struct {
+		SHA string `json:"sha"`
+	} `json:"commit"`
+}
+
+type githubCommit struct {
+	SHA     string `json:"sha"`
+	HTMLURL string `json:"html_url"`
+	Commit  struct {
+		Message string `json:"message"`
+		Author  struct {
+			Name string    `json:"name"`
+			Date time.Time `json:"date"`
+		} `json:"author"`
+		Committer struct {
+			Date time.Time `json:"date"`
+		} `json:"committer"`
+	} `json:"commit"`
+	Author *struct {
+		Login string `json:"login"`
+	} `json:"author"`
+}
+
+func (s *githubSource) Fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	repo := feed.Options["repo"]
+	if !githubRepoName.MatchString(repo) {
+		return nil, fmt.Errorf("github feed has no repository")
+	}
+	token := s.token(feed)
+
+	var endpoint string
+	switch githubMode(feed.Options) {
+	case githubModeTags:
+		endpoint = fmt.Sprintf("/repos/%s/tags?per_page=%d", repo, githubPageSize)
+	case githubModeCommits:
+		query := url.Values{"per_page": {strconv.Itoa(githubPageSize)}}
+		if branch := feed.Options["branch"]; branch != "" {
+			query.Set("sha", branch)
+		}
+		endpoint = fmt.Sprintf("/repos/%s/commits?%s", repo, query.Encode())
+	default:
+		endpoint = fmt.Sprintf("/repos/%s/releases?per_page=%d", repo, githubPageSize)
+	}
+
+	// Conditional requests that come back 304 don't count against the
+	// rate limit, so polling an idle repository is free
+	resp, err := s.get(ctx, endpoint, token, feed.ETag)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	fetchLog.StatusCode = resp.StatusCode
+	feed.FetchInterval = githubFetchInterval
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedSize))
+	fetchLog.Bytes = int64(len(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var articles []*models.Article
+	complete := true
+	switch githubMode(feed.Options) {
+	case githubModeTags:
+		articles, complete, err = s.tagArticles(ctx, feed, repo, token, body)
+	case githubModeCommits:
+		articles, err = commitArticles(feed, body)
+	default:
+		articles, err = releaseArticles(feed, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fetchLog.ItemCount = len(articles)
+
+	var created []*models.Article
+	for _, article := range articles {
+		result, err := upsertArticle(s.articleRepo, article)
+		if err != nil {
+			return created, err
+		}
+		switch result {
+		case articleCreated:
+			created = append(created, article)
+			fetchLog.NewArticles++
+		case articleUpdated:
+			fetchLog.UpdatedArticles++
+		}
+	}
+
+	// As with RSS feeds, the validator is only kept once everything is
+	// saved, and tags left for the next fetch need the list sent again
+	feed.ETag = ""
+	if complete {
+		feed.ETag = resp.Header.Get("ETag")
+	}
+	return created, s.feedRepo.UpdateCacheValidators(feed.ID.Hex(), feed.ETag, "")
+}
+
+func githubMode(options map[string]string) string {
+	switch mode := options["mode"]; mode {
+	case githubModeTags, githubModeCommits:
+		return mode
+	}
+	return githubModeReleases
+}
+
+// token returns the personal token of the user who added the feed. Only
+// personal feeds use it, as what it can see mustn't reach feeds everyone
+// reads.
+func (s *githubSource) token(feed *models.Feed) string {
+	if feed.IsDefault {
+		return ""
+	}
+	owner, err := s.userRepo.GetFeedOwner(feed.ID)
+	if err != nil || owner == nil {
+		return ""
+	}
+	return owner.GitHubToken
+}
+
+func (s *githubSource) get(ctx context.Context, endpoint, token, etag string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.apiURL+endpoint, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	// Ask for release notes rendered to HTML alongside the markdown
+	req.Header.Set("Accept", "application/vnd.github.html+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+
+	if resp.StatusCode != http.StatusNotModified && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		defer resp.Body.Close()
+		fetchErr := newFetchError(resp)
+		// An exhausted rate limit says when it resets rather than Retry-After
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+				if wait := time.Until(time.Unix(reset, 0)); wait > fetchErr.RetryAfter {
+					fetchErr.RetryAfter = wait
+				}
+			}
+		}
+		return nil, fetchErr
+	}
+	return resp, nil
+}
+
+// getJSON decodes the API response for endpoint into v
+func (s *githubSource) getJSON(ctx context.Context, endpoint, token string, v interface{}) error {
+	resp, err := s.get(ctx, endpoint, token, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxFeedSize)).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", endpoint, err)
+	}
+	return nil
+}
+
+func releaseArticles(feed *models.Feed, body []byte) ([]*models.Article, error) {
+	var releases []githubRelease
+	if err := json.Unmarshal(body, &releases); err != nil {
+		return nil, fmt.Errorf("invalid releases response: %w", err)
+	}
+
+	repo := feed.Options["repo"]
+	var articles []*models.Article
+	for _, release := range releases {
+		if release.Draft || (release.Prerelease && feed.Options["prereleases"] == "no") {
+			continue
+		}
+
+		article := models.NewArticle(feed.ID.Hex())
+		article.GUID = "github:release:" + strconv.FormatInt(release.ID, 10)
+		article.URL = release.HTMLURL
+		article.Title = repo + " " + release.TagName
+		if release.Name != "" && release.Name != release.TagName {
+			article.Title += ": " + release.Name
+		}
+		article.Author = release.Author.Login
+		article.Content = release.BodyHTML
+		article.PublishedAt = release.PublishedAt
+		if release.Prerelease {
+			article.Categories = []string{"prerelease"}
+		}
+		articles = append(articles, article)
+	}
+	return articles, nil
+}
+
+// tagArticles looks up the commit behind each new tag, as the tags list
+// carries neither dates nor messages. It reports whether every new tag was
+// looked up, or some were left for the next fetch.
+func (s *githubSource) tagArticles(ctx context.Context, feed *models.Feed, repo, token string, body []byte) ([]*models.Article, bool, error) {
+	var tags []githubTag
+	if err := json.Unmarshal(body, &tags); err != nil {
+		return nil, false, fmt.Errorf("invalid tags response: %w", err)
+	}
+
+	var articles []*models.Article
+	lookups := 0
+	for _, tag := range tags {
+		guid := "github:tag:" + tag.Name
+		if existing, err := s.articleRepo.FindArticle(feed.ID.Hex(), guid, ""); err != nil {
+			return nil, false, err
+		} else if existing != nil {
+			continue
+		}
+		if lookups >= githubMaxTagLookups {
+			return articles, false, nil
+		}
+		lookups++
+
+		var commit githubCommit
+		if err := s.getJSON(ctx, fmt.Sprintf("/repos/%s/commits/%s", repo, tag.Commit.SHA), token, &commit); err != nil {
+			return nil, false, err
+		}
+
+		article := commitArticle(feed, commit)
+		article.GUID = guid
+		article.URL = fmt.Sprintf("%s/%s/releases/tag/%s", githubURL, repo, url.PathEscape(tag.Name))
+		article.Title = repo + " " + tag.Name
+		articles = append(articles, article)
+	}
+	return articles, true, nil
+}
+
+func commitArticles(feed *models.Feed, body []byte) ([]*models.Article, error) {
+	var commits []githubCommit
+	if err := json.Unmarshal(body, &commits); err != nil {
+		return nil, fmt.Errorf("invalid commits response: %w", err)
+	}
+
+	var articles []*models.Article
+	for _, commit := range commits {
+		articles = append(articles, commitArticle(feed, commit))
+	}
+	return articles, nil
+}
+
+func commitArticle(feed *models.Feed, commit githubCommit) *models.Article {
+	summary, details, _ := strings.Cut(commit.Commit.Message, "\n")
+
+	article := models.NewArticle(feed.ID.Hex())
+	article.GUID = "github:commit:" + commit.SHA
+	article.URL = commit.HTMLURL
+	article.Title = strings.TrimSpace(summary)
+	article.Content = textToHTML(details)
+	article.Author = commit.Commit.Author.Name
+	if commit.Author != nil && commit.Author.Login != "" {
+		article.Author = commit.Author.Login
+	}
+	article.PublishedAt = commit.Commit.Committer.Date
+	if article.PublishedAt.IsZero() {
+		article.PublishedAt = commit.Commit.Author.Date
+	}
+	return article
+}
+
+// resolveGitHubFeed recognises owner/repo and github.com repository
+// addresses, following releases unless the address points at the tags or
+// commits of a branch
+func resolveGitHubFeed(ctx context.Context, input, token string) (*models.Feed, error) {
+	var repo, mode, branch string
+	if match := githubRepoName.FindStringSubmatch(input); match != nil {
+		repo = match[0]
+	} else {
+		parsed, err := url.Parse(input)
+		if err != nil || (parsed.Host != "github.com" && parsed.Host != "www.github.com") {
+			return nil, nil
+		}
+		segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+		if len(segments) < 2 || !githubRepoName.MatchString(segments[0]+"/"+segments[1]) {
+			return nil, nil
+		}
+		repo = segments[0] + "/" + strings.TrimSuffix(segments[1], ".git")
+		if len(segments) >= 3 {
+			switch segments[2] {
+			case "tags":
+				mode = githubModeTags
+			case "commits", "tree":
+				mode = githubModeCommits
+				branch = strings.Join(segments[3:], "/")
+			}
+		}
+	}
+
+	var info struct {
+		FullName      string `json:"full_name"`
+		Description   string `json:"description"`
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := (&githubSource{apiURL: githubAPIURL}).getJSON(ctx, "/repos/"+repo, token, &info); err != nil {
+		return nil, fmt.Errorf("could not find GitHub repository %s: %w", repo, err)
+	}
+	repo = info.FullName
+
+	feed := models.NewFeed(githubURL + "/" + repo + "/releases")
+	feed.Title = repo + " releases"
+	feed.Description = info.Description
+	feed.Kind = models.FeedKindGitHub
+	feed.Options = map[string]string{"repo": repo}
+	switch mode {
+	case githubModeTags:
+		feed.URL = githubURL + "/" + repo + "/tags"
+		feed.Title = repo + " tags"
+		feed.Options["mode"] = mode
+	case githubModeCommits:
+		if branch == "" {
+			branch = info.DefaultBranch
+		}
+		feed.URL = githubURL + "/" + repo + "/commits/" + branch
+		feed.Title = repo + " commits on " + branch
+		feed.Options["mode"] = mode
+		feed.Options["branch"] = branch
+	}
+	return feed, nil
+}
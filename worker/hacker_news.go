@@ -4,65 +4,154 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"redapplications.com/redreader/models"
 	"redapplications.com/redreader/repository"
+	"redapplications.com/redreader/sanitize"
 )
 
-type HackerNewsFetcher struct {
-	feedRepo    *repository.FeedRepository
+// hackerNewsSource imports stories from the Hacker News API
+type hackerNewsSource struct {
 	articleRepo *repository.ArticleRepository
 }
 
-func NewHackerNewsFetcher(feedRepo *repository.FeedRepository, articleRepo *repository.ArticleRepository) *HackerNewsFetcher {
-	return &HackerNewsFetcher{
-		feedRepo:    feedRepo,
-		articleRepo: articleRepo,
+// HackerNewsConfig selects which Hacker News stories are imported
+type HackerNewsConfig struct {
+	Lists       []string // Any of top, new, best, ask, show and job
+	MinScore    int
+	MinComments int
+	Concurrency int // Items fetched at once
+}
+
+const (
+	hnItemURL       = "https://news.ycombinator.com/item?id="
+	hnDefaultList   = "best"
+	hnMaxConcurrent = 8
+	hnFetchInterval = 15 * time.Minute
+	// Lists run to 500 stories, more than fit in one fetch's time, and
+	// only those near the top are worth importing
+	hnMaxStoriesPerList = 60
+)
+
+var hnAPIURL = "https://hacker-news.firebaseio.com/v0/"
+
+var hnListEndpoints = map[string]string{
+	"top":  "topstories.json",
+	"new":  "newstories.json",
+	"best": "beststories.json",
+	"ask":  "askstories.json",
+	"show": "showstories.json",
+	"job":  "jobstories.json",
+}
+
+// hackerNewsConfig reads the source's settings from the feed's options
+// ("lists", "min_score", "min_comments" and "concurrency"), falling back to
+// the HN_LISTS, HN_MIN_SCORE, HN_MIN_COMMENTS and HN_CONCURRENCY environment
+// variables
+func hackerNewsConfig(options map[string]string) HackerNewsConfig {
+	setting := func(option string, env string) string {
+		if value, ok := options[option]; ok {
+			return value
+		}
+		return os.Getenv(env)
 	}
+
+	config := HackerNewsConfig{Concurrency: hnMaxConcurrent}
+
+	for _, list := range strings.Split(setting("lists", "HN_LISTS"), ",") {
+		list = strings.ToLower(strings.TrimSpace(list))
+		if _, ok := hnListEndpoints[list]; ok {
+			config.Lists = append(config.Lists, list)
+		} else if list != "" {
+			println("Ignoring unknown Hacker News list:", list)
+		}
+	}
+	if len(config.Lists) == 0 {
+		config.Lists = []string{hnDefaultList}
+	}
+
+	config.MinScore, _ = strconv.Atoi(setting("min_score", "HN_MIN_SCORE"))
+	config.MinComments, _ = strconv.Atoi(setting("min_comments", "HN_MIN_COMMENTS"))
+	if concurrency, err := strconv.Atoi(setting("concurrency", "HN_CONCURRENCY")); err == nil && concurrency > 0 {
+		config.Concurrency = concurrency
+	}
+
+	return config
 }
 
-func (h *HackerNewsFetcher) FetchAndSave() error {
-	stories, err := FetchTopStories()
-	if err != nil {
-		return fmt.Errorf("failed to fetch HN stories: %v", err)
+func (h *hackerNewsSource) Options() []SourceOption {
+	return []SourceOption{
+		{Name: "lists", Label: "Lists", Help: "Comma separated: top, new, best, ask, show or job"},
+		{Name: "min_score", Label: "Minimum score", Help: "Skip stories with fewer points"},
+		{Name: "min_comments", Label: "Minimum comments", Help: "Skip stories with fewer comments"},
+		{Name: "concurrency", Label: "Concurrent requests", Help: "Stories fetched at once"},
 	}
+}
 
-	feed, err := h.feedRepo.GetFeedByTitle(context.Background(), "Hacker News")
+func newHackerNewsSource(articleRepo *repository.ArticleRepository) *hackerNewsSource {
+	return &hackerNewsSource{articleRepo: articleRepo}
+}
+
+func (h *hackerNewsSource) Fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	config := hackerNewsConfig(feed.Options)
+
+	stories, err := fetchStories(ctx, config)
 	if err != nil {
-		return fmt.Errorf("failed to get HN feed: %v", err)
+		return nil, fmt.Errorf("failed to fetch HN stories: %v", err)
 	}
+	fetchLog.StatusCode = http.StatusOK
+	fetchLog.ItemCount = len(stories)
+	feed.FetchInterval = hnFetchInterval
 
+	var created []*models.Article
 	for _, story := range stories {
-		// Skip stories without URLs
-		if story.URL == "" {
-			continue
-		}
-
-		// Check if article already exists
-		exists, err := h.articleRepo.ArticleExists(story.URL)
-		if err != nil || exists {
+		if story.Score < config.MinScore || story.Descendants < config.MinComments {
 			continue
 		}
 
 		article := models.NewArticle(feed.ID.Hex())
+		article.GUID = strconv.FormatInt(story.ID, 10)
 		article.Title = story.Title
-		article.URL = story.URL
+		article.CommentsURL = hnItemURL + article.GUID
+		article.HackerNewsID = story.ID
 		article.Author = story.By
 		article.Description = fmt.Sprintf("Points: %d | Comments: %d", story.Score, story.Descendants)
 
+		// Ask HN and Show HN posts without a link are read on HN itself
+		if story.URL != "" {
+			article.URL = CanonicalizeURL(story.URL)
+		} else {
+			article.URL = article.CommentsURL
+		}
+		if story.Text != "" {
+			article.Content = sanitize.ResolveURLs(story.Text, article.CommentsURL)
+		}
+
 		//Hacker News stories get to the front page by votes, well after their published date
 		//so we set the published date to the time the article was fetched to artificially boost it
 		article.PublishedAt = time.Now()
 
-		if err := h.articleRepo.CreateArticle(article); err != nil {
-			println("Error saving HN article:", err.Error())
-			continue
+		result, err := upsertArticle(h.articleRepo, article)
+		if err != nil {
+			return created, err
+		}
+		switch result {
+		case articleCreated:
+			created = append(created, article)
+			fetchLog.NewArticles++
+		case articleUpdated:
+			fetchLog.UpdatedArticles++
 		}
 	}
 
-	return nil
+	return created, nil
 }
 
 // Story represents a Hacker News story
@@ -70,6 +159,7 @@ type Story struct {
 	ID          int64     `json:"id"`
 	Title       string    `json:"title"`
 	URL         string    `json:"url"`
+	Text        string    `json:"text"`
 	Score       int       `json:"score"`
 	Time        time.Time `json:"-"`
 	RawTime     int64     `json:"time"`
@@ -77,44 +167,99 @@ type Story struct {
 	Type        string    `json:"type"`
 	Kids        []int64   `json:"kids"`
 	Descendants int       `json:"descendants"`
+	Dead        bool      `json:"dead"`
+	Deleted     bool      `json:"deleted"`
 	CreatedAt   time.Time
 }
 
-const (
-	url = "https://hacker-news.firebaseio.com/v0/"
-)
+// fetchStories fetches the stories near the top of the configured lists,
+// several at a time, skipping any that have been removed
+func fetchStories(ctx context.Context, config HackerNewsConfig) ([]Story, error) {
+	var storyIDs []int64
+	seen := make(map[int64]bool)
+	for _, list := range config.Lists {
+		ids, err := fetchStoryIDs(ctx, hnListEndpoints[list])
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) > hnMaxStoriesPerList {
+			ids = ids[:hnMaxStoriesPerList]
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				storyIDs = append(storyIDs, id)
+			}
+		}
+	}
+
+	results := make([]*Story, len(storyIDs))
+	slots := make(chan struct{}, max(config.Concurrency, 1))
+	var wg sync.WaitGroup
+	for i, id := range storyIDs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(i int, id int64) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			// Unknown items come back as null, leaving the ID unset
+			story, err := fetchStory(ctx, id)
+			if err != nil || story.ID == 0 || story.Dead || story.Deleted {
+				return
+			}
+			results[i] = &story
+		}(i, id)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 
-func FetchTopStories() ([]Story, error) {
-	resp, err := http.Get(url + "beststories.json")
+	// Keep the order of the lists
+	stories := make([]Story, 0, len(results))
+	for _, story := range results {
+		if story != nil {
+			stories = append(stories, *story)
+		}
+	}
+	return stories, nil
+}
+
+func fetchStoryIDs(ctx context.Context, endpoint string) ([]int64, error) {
+	resp, err := httpGet(ctx, hnAPIURL+endpoint)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch top stories: %v", err)
+		return nil, fmt.Errorf("failed to fetch %s: %v", endpoint, err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("failed to fetch %s: %w", endpoint, newFetchError(resp))
+	}
 
 	var storyIDs []int64
 	if err := json.NewDecoder(resp.Body).Decode(&storyIDs); err != nil {
 		return nil, fmt.Errorf("failed to decode story IDs: %v", err)
 	}
-
-	stories := make([]Story, 0, len(storyIDs))
-	for _, id := range storyIDs {
-		story, err := fetchStory(id)
-		if err != nil {
-			continue
-		}
-		stories = append(stories, story)
-	}
-
-	return stories, nil
+	return storyIDs, nil
 }
 
-func fetchStory(id int64) (Story, error) {
-	url := fmt.Sprintf(url+"item/%d.json", id)
-	resp, err := http.Get(url)
+func fetchStory(ctx context.Context, id int64) (Story, error) {
+	url := fmt.Sprintf(hnAPIURL+"item/%d.json", id)
+	resp, err := httpGet(ctx, url)
 	if err != nil {
 		return Story{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return Story{}, newFetchError(resp)
+	}
 
 	var story Story
 	if err := json.NewDecoder(resp.Body).Decode(&story); err != nil {
@@ -126,3 +271,43 @@ func fetchStory(id int64) (Story, error) {
 
 	return story, nil
 }
+
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	return httpGetAccept(ctx, url, "")
+}
+
+// httpGetAccept is httpGet asking for a particular media type, which
+// servers such as ActivityPub ones need to return JSON
+func httpGetAccept(ctx context.Context, url, accept string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// Tie the timeout to the body so it stays readable until closed
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
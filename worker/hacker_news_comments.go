@@ -0,0 +1,149 @@
+package worker
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"redapplications.com/redreader/sanitize"
+)
+
+const (
+	hnThreadCacheTTL   = 5 * time.Minute
+	hnMaxThreadEntries = 200
+	hnMaxComments      = 500
+)
+
+// Comment is a Hacker News comment with its replies
+type Comment struct {
+	ID      int64
+	By      string
+	Text    string // Sanitized HTML
+	Time    time.Time
+	Replies []*Comment
+}
+
+type cachedThread struct {
+	comments  []*Comment
+	fetchedAt time.Time
+}
+
+// HackerNewsThreads fetches comment trees from the Hacker News API and keeps
+// them for a few minutes so reopening a discussion is instant
+type HackerNewsThreads struct {
+	mu      sync.Mutex
+	threads map[int64]*cachedThread
+}
+
+func NewHackerNewsThreads() *HackerNewsThreads {
+	return &HackerNewsThreads{threads: make(map[int64]*cachedThread)}
+}
+
+// Thread returns the comments on a story, fetching them when they aren't
+// cached
+func (t *HackerNewsThreads) Thread(ctx context.Context, storyID int64) ([]*Comment, error) {
+	t.mu.Lock()
+	cached, ok := t.threads[storyID]
+	t.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < hnThreadCacheTTL {
+		return cached.comments, nil
+	}
+
+	story, err := fetchStory(ctx, storyID)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher := &threadFetcher{slots: make(chan struct{}, hnMaxConcurrent), remaining: hnMaxComments}
+	comments := fetcher.fetchComments(ctx, story.Kids)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune()
+	t.threads[storyID] = &cachedThread{comments: comments, fetchedAt: time.Now()}
+	return comments, nil
+}
+
+// prune drops expired threads and, if the cache is still full, the oldest
+func (t *HackerNewsThreads) prune() {
+	var oldest int64
+	for id, thread := range t.threads {
+		if time.Since(thread.fetchedAt) >= hnThreadCacheTTL {
+			delete(t.threads, id)
+			continue
+		}
+		if oldest == 0 || thread.fetchedAt.Before(t.threads[oldest].fetchedAt) {
+			oldest = id
+		}
+	}
+	if len(t.threads) >= hnMaxThreadEntries {
+		delete(t.threads, oldest)
+	}
+}
+
+// threadFetcher walks a comment tree, fetching siblings concurrently and
+// stopping once the comment budget is spent
+type threadFetcher struct {
+	slots     chan struct{}
+	mu        sync.Mutex
+	remaining int
+}
+
+func (f *threadFetcher) take() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.remaining <= 0 {
+		return false
+	}
+	f.remaining--
+	return true
+}
+
+func (f *threadFetcher) fetchComments(ctx context.Context, ids []int64) []*Comment {
+	results := make([]*Comment, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		if !f.take() {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, id int64) {
+			defer wg.Done()
+
+			select {
+			case f.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			item, err := fetchStory(ctx, id)
+			<-f.slots
+			if err != nil || item.Deleted || item.Dead {
+				return
+			}
+
+			// Replies are fetched after releasing the slot so deep
+			// threads can't hold every slot waiting on their children
+			results[i] = &Comment{
+				ID:      item.ID,
+				By:      item.By,
+				Text:    sanitize.HTML(sanitize.ResolveURLs(item.Text, hnItemURL+strconv.FormatInt(item.ID, 10))),
+				Time:    item.Time,
+				Replies: f.fetchComments(ctx, item.Kids),
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	comments := make([]*Comment, 0, len(results))
+	for _, comment := range results {
+		if comment != nil {
+			comments = append(comments, comment)
+		}
+	}
+	return comments
+}
@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newHackerNewsServer answers for the Hacker News API with the given
+// documents by path, and 404 for anything else
+func newHackerNewsServer(t *testing.T, documents map[string]string) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		document, ok := documents[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(document))
+	}))
+	t.Cleanup(server.Close)
+
+	apiURL := hnAPIURL
+	hnAPIURL = server.URL + "/v0/"
+	t.Cleanup(func() { hnAPIURL = apiURL })
+}
+
+func TestFetchStoriesSkipsMissingItems(t *testing.T) {
+	newHackerNewsServer(t, map[string]string{
+		"/v0/beststories.json": `[1, 2, 3, 4, 5]`,
+		"/v0/item/1.json":      `{"id": 1, "type": "story", "title": "Kept", "score": 10}`,
+		"/v0/item/2.json":      `null`,
+		"/v0/item/3.json":      `{"id": 3, "deleted": true}`,
+		"/v0/item/4.json":      `{"id": 4, "dead": true, "title": "Flagged"}`,
+	})
+
+	stories, err := fetchStories(context.Background(), HackerNewsConfig{Lists: []string{"best"}, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stories) != 1 || stories[0].ID != 1 {
+		t.Errorf("stories = %+v, want only story 1", stories)
+	}
+}
+
+func TestFetchStoriesReportsListErrors(t *testing.T) {
+	newHackerNewsServer(t, map[string]string{})
+
+	_, err := fetchStories(context.Background(), HackerNewsConfig{Lists: []string{"top"}, Concurrency: 1})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("err = %v, want the list's status reported", err)
+	}
+}
+
+func TestFetchStoriesKeepsTheTopOfEachList(t *testing.T) {
+	documents := make(map[string]string)
+	var ids []string
+	for id := 1; id <= hnMaxStoriesPerList+20; id++ {
+		ids = append(ids, fmt.Sprint(id))
+		documents[fmt.Sprintf("/v0/item/%d.json", id)] = fmt.Sprintf(`{"id": %d, "type": "story"}`, id)
+	}
+	documents["/v0/newstories.json"] = "[" + strings.Join(ids, ",") + "]"
+	newHackerNewsServer(t, documents)
+
+	stories, err := fetchStories(context.Background(), HackerNewsConfig{Lists: []string{"new"}, Concurrency: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stories) != hnMaxStoriesPerList || stories[0].ID != 1 || stories[len(stories)-1].ID != hnMaxStoriesPerList {
+		t.Errorf("got %d stories, want the first %d in order", len(stories), hnMaxStoriesPerList)
+	}
+}
@@ -0,0 +1,96 @@
+package worker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+var trackingParams = map[string]bool{
+	"fbclid":      true,
+	"gclid":       true,
+	"dclid":       true,
+	"msclkid":     true,
+	"yclid":       true,
+	"igshid":      true,
+	"mc_cid":      true,
+	"mc_eid":      true,
+	"_hsenc":      true,
+	"_hsmi":       true,
+	"ref_src":     true,
+	"ref_url":     true,
+	"mkt_tok":     true,
+	"oly_anon_id": true,
+	"oly_enc_id":  true,
+	"vero_id":     true,
+	"wt_mc":       true,
+}
+
+// CanonicalizeURL normalises a link so the same article reached through
+// different campaign links compares equal: the scheme and host are lower
+// cased, default ports and fragments dropped and tracking parameters removed
+func CanonicalizeURL(rawURL string) string {
+	rawURL = strings.TrimSpace(rawURL)
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return rawURL
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	if (parsed.Scheme == "http" && parsed.Port() == "80") || (parsed.Scheme == "https" && parsed.Port() == "443") {
+		parsed.Host = parsed.Hostname()
+	}
+	parsed.Fragment = ""
+	parsed.RawFragment = ""
+
+	if parsed.RawQuery != "" {
+		var kept []string
+		for _, param := range strings.Split(parsed.RawQuery, "&") {
+			if param == "" {
+				continue
+			}
+			key, _, _ := strings.Cut(param, "=")
+			if name, err := url.QueryUnescape(key); err == nil {
+				key = name
+			}
+			key = strings.ToLower(key)
+			if strings.HasPrefix(key, "utm_") || trackingParams[key] {
+				continue
+			}
+			kept = append(kept, param)
+		}
+		parsed.RawQuery = strings.Join(kept, "&")
+	}
+
+	return parsed.String()
+}
+
+// itemIdentity returns the key an item is stored under within its feed: the
+// publisher's GUID when there is one, otherwise its canonical link, otherwise a
+// hash of its title and date
+func itemIdentity(item *gofeed.Item) string {
+	if guid := strings.TrimSpace(item.GUID); guid != "" {
+		return guid
+	}
+
+	if item.Link != "" {
+		return CanonicalizeURL(item.Link)
+	}
+
+	var date string
+	if item.PublishedParsed != nil {
+		date = item.PublishedParsed.UTC().Format(time.RFC3339)
+	} else if item.UpdatedParsed != nil {
+		date = item.UpdatedParsed.UTC().Format(time.RFC3339)
+	} else {
+		date = item.Published
+	}
+
+	hash := sha256.Sum256([]byte(strings.TrimSpace(item.Title) + "\x00" + date))
+	return "hash:" + hex.EncodeToString(hash[:])
+}
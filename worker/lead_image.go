@@ -0,0 +1,155 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+	"redapplications.com/redreader/models"
+)
+
+const (
+	maxLeadImageLookups = 10
+)
+
+// Page metadata naming the image to show when the page is shared, in order
+// of preference
+var pageImageProperties = []string{"og:image:secure_url", "og:image", "og:image:url", "twitter:image", "twitter:image:src"}
+
+// leadImage picks the image to show alongside an article in the list views,
+// preferring images the feed names explicitly over ones found in the content
+func leadImage(parsedFeed *gofeed.Feed, item *gofeed.Item, article *models.Article) string {
+	media := item.Extensions["media"]
+	if thumbnails := media["thumbnail"]; len(thumbnails) > 0 && thumbnails[0].Attrs["url"] != "" {
+		return thumbnails[0].Attrs["url"]
+	}
+	for _, content := range append(mediaContents(media), media["group"]...) {
+		if thumbnails := content.Children["thumbnail"]; len(thumbnails) > 0 && thumbnails[0].Attrs["url"] != "" {
+			return thumbnails[0].Attrs["url"]
+		}
+	}
+
+	for _, enclosure := range article.Enclosures {
+		if enclosure.IsImage() {
+			return enclosure.URL
+		}
+	}
+	for _, enclosure := range article.Enclosures {
+		if enclosure.Image != "" {
+			return enclosure.Image
+		}
+	}
+	if item.Image != nil && item.Image.URL != "" {
+		return item.Image.URL
+	}
+
+	if image := firstContentImage(article.Content); image != "" {
+		return image
+	}
+	return firstContentImage(article.Description)
+}
+
+// firstContentImage returns the first image in an article's HTML that isn't a
+// tracking pixel or inline data
+func firstContentImage(content string) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return ""
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+		if token.Data != "img" {
+			continue
+		}
+
+		width, height := strings.TrimSpace(attr(token, "width")), strings.TrimSpace(attr(token, "height"))
+		if (width == "0" || width == "1") && (height == "0" || height == "1") {
+			continue
+		}
+
+		src := attr(token, "src")
+		if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+			return src
+		}
+	}
+}
+
+// pageImage returns the sharing image a web page declares in its metadata
+func pageImage(body []byte, base *url.URL) string {
+	found := make(map[string]string)
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+scan:
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+
+		token := tokenizer.Token()
+		switch token.Data {
+		case "body":
+			break scan
+		case "meta":
+			name := attr(token, "property")
+			if name == "" {
+				name = attr(token, "name")
+			}
+			name = strings.ToLower(strings.TrimSpace(name))
+			if content := strings.TrimSpace(attr(token, "content")); content != "" && found[name] == "" {
+				found[name] = content
+			}
+		}
+	}
+
+	for _, property := range pageImageProperties {
+		if found[property] == "" {
+			continue
+		}
+		resolved, err := base.Parse(found[property])
+		if err != nil || (resolved.Scheme != "http" && resolved.Scheme != "https") {
+			continue
+		}
+		return resolved.String()
+	}
+	return ""
+}
+
+// fetchLeadImages looks up the sharing image of each article's page, for
+// articles whose feed entry didn't carry an image of its own
+func (f *FeedFetcher) fetchLeadImages(ctx context.Context, articles []*models.Article) {
+	lookups := 0
+	for _, article := range articles {
+		if ctx.Err() != nil || lookups >= maxLeadImageLookups {
+			return
+		}
+		if article.ImageURL != "" || article.URL == "" {
+			continue
+		}
+		lookups++
+
+		body, finalURL, err := fetchDocument(ctx, article.URL)
+		if err != nil {
+			println("Error fetching article page:", article.URL, err.Error())
+			continue
+		}
+
+		if image := pageImage(body, finalURL); image != "" {
+			article.ImageURL = image
+			if err := f.articleRepo.UpdateImageURL(article.ID, image); err != nil {
+				println("Error saving article image:", article.URL, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,648 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	xhtml "golang.org/x/net/html"
+	"redapplications.com/redreader/models"
+	"redapplications.com/redreader/repository"
+)
+
+const (
+	mastodonFetchInterval = 30 * time.Minute
+	mastodonPageLimit     = 40
+	mastodonMaxBoosts     = 10
+	mastodonTitleLength   = 80
+
+	activityJSON = `application/activity+json, application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
+)
+
+// mastodonInstanceURL is the address of the server named in a handle such as
+// @user@host, which only says which host to ask
+var mastodonInstanceURL = func(host string) string {
+	return "https://" + host
+}
+
+// mastodonSource imports the public posts of a fediverse account, read from
+// its ActivityPub outbox, or of a hashtag on one instance, read from the
+// instance's public timeline API
+type mastodonSource struct {
+	articleRepo *repository.ArticleRepository
+}
+
+func newMastodonSource(articleRepo *repository.ArticleRepository) *mastodonSource {
+	return &mastodonSource{articleRepo: articleRepo}
+}
+
+func (s *mastodonSource) Options() []SourceOption {
+	return []SourceOption{
+		{Name: "boosts", Label: "Boosts", Help: "yes to include posts the account boosted"},
+		{Name: "replies", Label: "Replies", Help: "yes to include the account's replies"},
+	}
+}
+
+// mastodonPost is a post from either an outbox or the timeline API
+type mastodonPost struct {
+	ID          string
+	URL         string
+	Author      string
+	Content     string
+	Summary     string
+	Published   time.Time
+	Attachments []mastodonAttachment
+	Tags        []string
+	InReplyTo   string
+	BoostedBy   string
+}
+
+type mastodonAttachment struct {
+	URL         string
+	MediaType   string
+	Preview     string
+	Description string
+	Duration    int
+}
+
+func (s *mastodonSource) Fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	var posts []mastodonPost
+	var err error
+	if feed.Options["tag"] != "" {
+		posts, fetchLog.StatusCode, err = fetchMastodonTag(ctx, feed.Options["instance"], feed.Options["tag"])
+	} else {
+		posts, fetchLog.StatusCode, err = fetchMastodonAccount(ctx, feed.Options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fetchLog.ItemCount = len(posts)
+	feed.FetchInterval = mastodonFetchInterval
+
+	var created []*models.Article
+	for _, post := range posts {
+		if post.BoostedBy != "" && feed.Options["boosts"] != "yes" {
+			continue
+		}
+		if post.InReplyTo != "" && post.BoostedBy == "" && feed.Options["replies"] != "yes" {
+			continue
+		}
+
+		article := mastodonArticle(feed, post)
+		result, err := upsertArticle(s.articleRepo, article)
+		if err != nil {
+			return created, err
+		}
+		switch result {
+		case articleCreated:
+			created = append(created, article)
+			fetchLog.NewArticles++
+		case articleUpdated:
+			fetchLog.UpdatedArticles++
+		}
+	}
+
+	return created, nil
+}
+
+func mastodonArticle(feed *models.Feed, post mastodonPost) *models.Article {
+	article := models.NewArticle(feed.ID.Hex())
+	article.GUID = post.ID
+	article.URL = post.URL
+	if article.URL == "" {
+		article.URL = post.ID
+	}
+	article.Author = post.Author
+	article.PublishedAt = post.Published
+	if article.PublishedAt.IsZero() {
+		article.PublishedAt = time.Now()
+	}
+	article.Title = postTitle(post)
+	if post.BoostedBy != "" {
+		article.Title = "Boosted: " + article.Title
+		article.Description = "Boosted by " + post.BoostedBy
+		article.Categories = append(article.Categories, "boost")
+	}
+	article.Categories = models.NormalizeTags(append(article.Categories, post.Tags...))
+
+	var content strings.Builder
+	if post.Summary != "" {
+		fmt.Fprintf(&content, "<p><strong>%s</strong></p>", html.EscapeString(post.Summary))
+	}
+	content.WriteString(post.Content)
+	for _, attachment := range post.Attachments {
+		switch {
+		case strings.HasPrefix(attachment.MediaType, "image/"):
+			fmt.Fprintf(&content, `<figure><img src="%s" alt="%s"></figure>`,
+				html.EscapeString(attachment.URL), html.EscapeString(attachment.Description))
+			if article.ImageURL == "" {
+				article.ImageURL = attachment.URL
+			}
+		case strings.HasPrefix(attachment.MediaType, "video/"), strings.HasPrefix(attachment.MediaType, "audio/"):
+			article.Enclosures = append(article.Enclosures, models.Enclosure{
+				URL:      attachment.URL,
+				Type:     attachment.MediaType,
+				Duration: attachment.Duration,
+				Image:    attachment.Preview,
+			})
+			if article.ImageURL == "" {
+				article.ImageURL = attachment.Preview
+			}
+		}
+	}
+	article.Content = content.String()
+
+	return article
+}
+
+// postTitle makes a title from the start of a post's text, as fediverse
+// posts don't have one. Content warnings are used as they are.
+func postTitle(post mastodonPost) string {
+	if post.Summary != "" {
+		return post.Summary
+	}
+
+	// Inline markup such as the span in a hashtag link doesn't break words,
+	// paragraphs and line breaks do
+	var buf strings.Builder
+	tokenizer := xhtml.NewTokenizer(strings.NewReader(post.Content))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == xhtml.ErrorToken {
+			break
+		}
+		switch tokenType {
+		case xhtml.TextToken:
+			buf.Write(tokenizer.Text())
+		case xhtml.StartTagToken, xhtml.EndTagToken, xhtml.SelfClosingTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "p" || string(name) == "br" {
+				buf.WriteString(" ")
+			}
+		}
+	}
+	text := []rune(strings.Join(strings.Fields(buf.String()), " "))
+	if len(text) == 0 {
+		return "Post by " + post.Author
+	}
+	if len(text) > mastodonTitleLength {
+		return strings.TrimSpace(string(text[:mastodonTitleLength])) + "…"
+	}
+	return string(text)
+}
+
+// resolveMastodonFeed recognises @user@instance and #tag@instance handles
+// and the profile and hashtag pages of fediverse servers
+func resolveMastodonFeed(ctx context.Context, input string) (*models.Feed, error) {
+	if strings.HasPrefix(input, "#") && strings.Contains(input, "@") {
+		tag, host, _ := strings.Cut(strings.TrimPrefix(input, "#"), "@")
+		if tag == "" || host == "" {
+			return nil, fmt.Errorf("invalid hashtag: %s", input)
+		}
+		return mastodonTagFeed(mastodonInstanceURL(host), tag), nil
+	}
+	if !strings.Contains(input, "/") && strings.Count(input, "@") >= 1 {
+		user, host, _ := strings.Cut(strings.TrimPrefix(input, "@"), "@")
+		if user == "" || host == "" || strings.Contains(host, "@") {
+			return nil, fmt.Errorf("invalid account: %s", input)
+		}
+		return mastodonAccountFeed(ctx, mastodonInstanceURL(host), user+"@"+host)
+	}
+
+	parsed, err := url.Parse(input)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return nil, nil
+	}
+	instance := parsed.Scheme + "://" + parsed.Host
+	segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+
+	var account, tag string
+	switch {
+	case len(segments) == 1 && strings.HasPrefix(segments[0], "@") && len(segments[0]) > 1:
+		account = strings.TrimPrefix(segments[0], "@")
+	case len(segments) == 2 && segments[0] == "users":
+		account = segments[1]
+	case len(segments) == 2 && segments[0] == "tags":
+		tag = segments[1]
+	default:
+		return nil, nil
+	}
+
+	// Plenty of other sites use these paths, so only fediverse servers,
+	// which publish NodeInfo, are treated as such
+	if !isFediverseServer(ctx, instance) {
+		return nil, nil
+	}
+	if tag != "" {
+		return mastodonTagFeed(instance, tag), nil
+	}
+	if !strings.Contains(account, "@") {
+		account += "@" + parsed.Host
+	}
+	return mastodonAccountFeed(ctx, instance, account)
+}
+
+func isFediverseServer(ctx context.Context, instance string) bool {
+	var nodeInfo struct {
+		Links []struct {
+			Rel string `json:"rel"`
+		} `json:"links"`
+	}
+	if _, err := getJSON(ctx, instance+"/.well-known/nodeinfo", &nodeInfo); err != nil {
+		return false
+	}
+	return len(nodeInfo.Links) > 0
+}
+
+func mastodonTagFeed(instance, tag string) *models.Feed {
+	tag = strings.TrimPrefix(tag, "#")
+	feed := models.NewFeed(instance + "/tags/" + url.PathEscape(tag))
+	feed.Kind = models.FeedKindMastodon
+	feed.Title = "#" + tag + " on " + strings.TrimPrefix(strings.TrimPrefix(instance, "https://"), "http://")
+	feed.Options = map[string]string{"instance": instance, "tag": tag}
+	return feed
+}
+
+// mastodonAccountFeed looks the account up with WebFinger, which also
+// finds accounts whose handle names a domain other than their server's
+func mastodonAccountFeed(ctx context.Context, instance, account string) (*models.Feed, error) {
+	var finger struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Type string `json:"type"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	query := url.Values{"resource": {"acct:" + account}}
+	if _, err := getJSONAccept(ctx, instance+"/.well-known/webfinger?"+query.Encode(), "application/jrd+json, application/json", &finger); err != nil {
+		return nil, fmt.Errorf("could not find %s: %w", account, err)
+	}
+
+	var actorURL string
+	for _, link := range finger.Links {
+		if link.Rel == "self" && (strings.HasPrefix(link.Type, "application/activity+json") || strings.HasPrefix(link.Type, "application/ld+json")) {
+			actorURL = link.Href
+			break
+		}
+	}
+	if actorURL == "" {
+		return nil, fmt.Errorf("%s has no ActivityPub actor", account)
+	}
+
+	actor, err := url.Parse(actorURL)
+	if err != nil || actor.Host == "" {
+		return nil, fmt.Errorf("%s has an invalid actor address", account)
+	}
+
+	feedURL := actorURL
+	var profile activityActor
+	if _, err := getJSONAccept(ctx, actorURL, activityJSON, &profile); err == nil && profile.URL != "" {
+		feedURL = string(profile.URL)
+	}
+
+	feed := models.NewFeed(feedURL)
+	feed.Kind = models.FeedKindMastodon
+	feed.Title = "@" + account
+	if profile.Name != "" {
+		feed.Title = profile.Name + " (@" + account + ")"
+	}
+	feed.Options = map[string]string{
+		"instance": actor.Scheme + "://" + actor.Host,
+		"account":  account,
+		"actor":    actorURL,
+	}
+	return feed, nil
+}
+
+// activityLink is an ActivityStreams property that may hold a URL, a link
+// or object with one, or a list of those
+type activityLink string
+
+func (l *activityLink) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*l = activityLink(linkValue(value))
+	return nil
+}
+
+func linkValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		for _, key := range []string{"href", "id", "url"} {
+			if s, ok := v[key].(string); ok {
+				return s
+			}
+		}
+	case []interface{}:
+		// Prefer the HTML page when several representations are listed
+		for _, item := range v {
+			if link, ok := item.(map[string]interface{}); ok && link["mediaType"] == "text/html" {
+				return linkValue(link)
+			}
+		}
+		if len(v) > 0 {
+			return linkValue(v[0])
+		}
+	}
+	return ""
+}
+
+type activityActor struct {
+	ID                string       `json:"id"`
+	Name              string       `json:"name"`
+	PreferredUsername string       `json:"preferredUsername"`
+	URL               activityLink `json:"url"`
+	Outbox            string       `json:"outbox"`
+}
+
+type activityCollection struct {
+	First        json.RawMessage   `json:"first"`
+	OrderedItems []json.RawMessage `json:"orderedItems"`
+}
+
+type activity struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Actor     activityLink    `json:"actor"`
+	Published time.Time       `json:"published"`
+	Object    json.RawMessage `json:"object"`
+}
+
+type activityNote struct {
+	ID           string       `json:"id"`
+	Type         string       `json:"type"`
+	URL          activityLink `json:"url"`
+	AttributedTo activityLink `json:"attributedTo"`
+	Content      string       `json:"content"`
+	Summary      string       `json:"summary"`
+	Published    time.Time    `json:"published"`
+	InReplyTo    activityLink `json:"inReplyTo"`
+	Attachment   []struct {
+		MediaType string       `json:"mediaType"`
+		URL       activityLink `json:"url"`
+		Name      string       `json:"name"`
+	} `json:"attachment"`
+	Tag []struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	} `json:"tag"`
+}
+
+// fetchMastodonAccount reads the account's outbox, falling back to the
+// Mastodon API on servers that only serve outboxes to signed requests
+func fetchMastodonAccount(ctx context.Context, options map[string]string) ([]mastodonPost, int, error) {
+	var actor activityActor
+	status, err := getJSONAccept(ctx, options["actor"], activityJSON, &actor)
+	if err == nil && actor.Outbox != "" {
+		var posts []mastodonPost
+		posts, status, err = fetchOutbox(ctx, actor)
+		if err == nil {
+			return posts, status, nil
+		}
+	}
+
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) && (fetchErr.StatusCode == http.StatusUnauthorized || fetchErr.StatusCode == http.StatusForbidden) {
+		return fetchMastodonStatuses(ctx, options["instance"], options["account"])
+	}
+	if err == nil {
+		err = fmt.Errorf("%s has no outbox", options["account"])
+	}
+	return nil, status, err
+}
+
+func fetchOutbox(ctx context.Context, actor activityActor) ([]mastodonPost, int, error) {
+	var outbox activityCollection
+	status, err := getJSONAccept(ctx, actor.Outbox, activityJSON, &outbox)
+	if err != nil {
+		return nil, status, err
+	}
+
+	// The first page is usually linked rather than embedded
+	page := outbox
+	if len(outbox.OrderedItems) == 0 && len(outbox.First) > 0 {
+		var first activityLink
+		if err := json.Unmarshal(outbox.First, &first); err != nil || first == "" {
+			return nil, status, fmt.Errorf("invalid outbox: %v", err)
+		}
+		if err := json.Unmarshal(outbox.First, &page); err != nil || len(page.OrderedItems) == 0 {
+			status, err = getJSONAccept(ctx, string(first), activityJSON, &page)
+			if err != nil {
+				return nil, status, err
+			}
+		}
+	}
+
+	author := actor.Name
+	if author == "" {
+		author = actor.PreferredUsername
+	}
+
+	var posts []mastodonPost
+	boosts := 0
+	for _, raw := range page.OrderedItems {
+		var item activity
+		if err := json.Unmarshal(raw, &item); err != nil {
+			continue
+		}
+
+		switch item.Type {
+		case "Create":
+			var note activityNote
+			if err := json.Unmarshal(item.Object, &note); err != nil || note.Type == "" {
+				continue
+			}
+			post := notePost(note, author)
+			if post.Published.IsZero() {
+				post.Published = item.Published
+			}
+			posts = append(posts, post)
+		case "Announce":
+			// Boosted posts are only referenced, so each costs a request
+			if boosts >= mastodonMaxBoosts {
+				continue
+			}
+			boosts++
+			note, err := fetchNote(ctx, item.Object)
+			if err != nil {
+				continue
+			}
+			post := notePost(note, actorHandle(string(note.AttributedTo)))
+			post.ID = item.ID
+			post.BoostedBy = author
+			if !item.Published.IsZero() {
+				post.Published = item.Published
+			}
+			posts = append(posts, post)
+		}
+	}
+	return posts, status, nil
+}
+
+func fetchNote(ctx context.Context, object json.RawMessage) (activityNote, error) {
+	var note activityNote
+	if err := json.Unmarshal(object, &note); err == nil && note.Content != "" {
+		return note, nil
+	}
+	var link activityLink
+	if err := json.Unmarshal(object, &link); err != nil || link == "" {
+		return note, fmt.Errorf("boost has no object")
+	}
+	_, err := getJSONAccept(ctx, string(link), activityJSON, &note)
+	return note, err
+}
+
+// actorHandle turns an actor address such as https://example.social/users/bob
+// into bob@example.social, saving a request for the actor's profile
+func actorHandle(actorURL string) string {
+	parsed, err := url.Parse(actorURL)
+	if err != nil || parsed.Host == "" {
+		return actorURL
+	}
+	name := strings.TrimPrefix(parsed.Path[strings.LastIndex(parsed.Path, "/")+1:], "@")
+	return name + "@" + parsed.Host
+}
+
+func notePost(note activityNote, author string) mastodonPost {
+	post := mastodonPost{
+		ID:        note.ID,
+		URL:       string(note.URL),
+		Author:    author,
+		Content:   note.Content,
+		Summary:   note.Summary,
+		Published: note.Published,
+		InReplyTo: string(note.InReplyTo),
+	}
+	for _, attachment := range note.Attachment {
+		post.Attachments = append(post.Attachments, mastodonAttachment{
+			URL:         string(attachment.URL),
+			MediaType:   attachment.MediaType,
+			Description: attachment.Name,
+		})
+	}
+	for _, tag := range note.Tag {
+		if tag.Type == "Hashtag" {
+			post.Tags = append(post.Tags, strings.TrimPrefix(tag.Name, "#"))
+		}
+	}
+	return post
+}
+
+type mastodonStatus struct {
+	ID          string    `json:"id"`
+	URI         string    `json:"uri"`
+	URL         string    `json:"url"`
+	CreatedAt   time.Time `json:"created_at"`
+	Content     string    `json:"content"`
+	SpoilerText string    `json:"spoiler_text"`
+	InReplyToID string    `json:"in_reply_to_id"`
+	Account     struct {
+		Acct        string `json:"acct"`
+		DisplayName string `json:"display_name"`
+	} `json:"account"`
+	Reblog           *mastodonStatus `json:"reblog"`
+	MediaAttachments []struct {
+		Type        string `json:"type"`
+		URL         string `json:"url"`
+		PreviewURL  string `json:"preview_url"`
+		Description string `json:"description"`
+		Meta        struct {
+			Original struct {
+				Duration float64 `json:"duration"`
+			} `json:"original"`
+		} `json:"meta"`
+	} `json:"media_attachments"`
+	Tags []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+}
+
+// mastodonMediaTypes maps the Mastodon API's attachment types to the media
+// types the outbox reports
+var mastodonMediaTypes = map[string]string{
+	"image": "image/jpeg",
+	"gifv":  "video/mp4",
+	"video": "video/mp4",
+	"audio": "audio/mpeg",
+}
+
+func fetchMastodonTag(ctx context.Context, instance, tag string) ([]mastodonPost, int, error) {
+	var statuses []mastodonStatus
+	timelineURL := fmt.Sprintf("%s/api/v1/timelines/tag/%s?limit=%d", instance, url.PathEscape(tag), mastodonPageLimit)
+	status, err := getJSON(ctx, timelineURL, &statuses)
+	if err != nil {
+		return nil, status, err
+	}
+	return statusPosts(statuses), status, nil
+}
+
+func fetchMastodonStatuses(ctx context.Context, instance, account string) ([]mastodonPost, int, error) {
+	var found struct {
+		ID string `json:"id"`
+	}
+	status, err := getJSON(ctx, instance+"/api/v1/accounts/lookup?acct="+url.QueryEscape(account), &found)
+	if err != nil {
+		return nil, status, err
+	}
+
+	var statuses []mastodonStatus
+	statusesURL := fmt.Sprintf("%s/api/v1/accounts/%s/statuses?limit=%d", instance, url.PathEscape(found.ID), mastodonPageLimit)
+	status, err = getJSON(ctx, statusesURL, &statuses)
+	if err != nil {
+		return nil, status, err
+	}
+	return statusPosts(statuses), status, nil
+}
+
+func statusPosts(statuses []mastodonStatus) []mastodonPost {
+	var posts []mastodonPost
+	for _, status := range statuses {
+		post := statusPost(status)
+		if status.Reblog != nil {
+			boosted := statusPost(*status.Reblog)
+			boosted.ID = post.ID
+			boosted.Published = post.Published
+			boosted.BoostedBy = post.Author
+			post = boosted
+		}
+		posts = append(posts, post)
+	}
+	return posts
+}
+
+func statusPost(status mastodonStatus) mastodonPost {
+	post := mastodonPost{
+		ID:        status.URI,
+		URL:       status.URL,
+		Author:    status.Account.DisplayName,
+		Content:   status.Content,
+		Summary:   status.SpoilerText,
+		Published: status.CreatedAt,
+		InReplyTo: status.InReplyToID,
+	}
+	if post.Author == "" {
+		post.Author = status.Account.Acct
+	}
+	for _, attachment := range status.MediaAttachments {
+		post.Attachments = append(post.Attachments, mastodonAttachment{
+			URL:         attachment.URL,
+			MediaType:   mastodonMediaTypes[attachment.Type],
+			Preview:     attachment.PreviewURL,
+			Description: attachment.Description,
+			Duration:    int(attachment.Meta.Original.Duration),
+		})
+	}
+	for _, tag := range status.Tags {
+		post.Tags = append(post.Tags, tag.Name)
+	}
+	return post
+}
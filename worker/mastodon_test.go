@@ -0,0 +1,293 @@
+package worker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"redapplications.com/redreader/models"
+)
+
+// fediverseServer serves the recorded documents in testdata/mastodon, with
+// {{server}} in them replaced by the server's own address
+type fediverseServer struct {
+	*httptest.Server
+	routes   map[string]string // Fixture by path, or path and query
+	statuses map[string]int    // Status to answer with instead, by path
+	requests []*http.Request
+}
+
+func newFediverseServer(t *testing.T, routes map[string]string) *fediverseServer {
+	t.Helper()
+	server := &fediverseServer{routes: routes, statuses: make(map[string]int)}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.requests = append(server.requests, r)
+		if status, ok := server.statuses[r.URL.Path]; ok {
+			w.WriteHeader(status)
+			return
+		}
+		fixture, ok := server.routes[r.URL.Path+"?"+r.URL.RawQuery]
+		if !ok {
+			fixture, ok = server.routes[r.URL.Path]
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		body := strings.ReplaceAll(string(readFixture(t, "mastodon/"+fixture)), "{{server}}", server.URL)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	// Handles name the host only, so send them all to this server
+	instanceURL := mastodonInstanceURL
+	mastodonInstanceURL = func(string) string { return server.URL }
+	t.Cleanup(func() { mastodonInstanceURL = instanceURL })
+
+	return server
+}
+
+// request returns the first request made for path
+func (s *fediverseServer) request(path string) *http.Request {
+	for _, r := range s.requests {
+		if r.URL.Path == path {
+			return r
+		}
+	}
+	return nil
+}
+
+var accountRoutes = map[string]string{
+	"/.well-known/webfinger":         "webfinger.json",
+	"/.well-known/nodeinfo":          "nodeinfo.json",
+	"/users/alice":                   "actor.json",
+	"/users/alice/outbox":            "outbox.json",
+	"/users/alice/outbox?page=true":  "outbox_page.json",
+	"/users/bob/statuses/9":          "boosted_note.json",
+	"/api/v1/accounts/lookup":        "lookup.json",
+	"/api/v1/accounts/1099/statuses": "statuses.json",
+	"/api/v1/timelines/tag/golang":   "statuses.json",
+}
+
+func TestResolveMastodonHandle(t *testing.T) {
+	server := newFediverseServer(t, accountRoutes)
+
+	feed, err := resolveMastodonFeed(context.Background(), "@alice@social.test")
+	if err != nil || feed == nil {
+		t.Fatalf("feed = %v, err = %v", feed, err)
+	}
+
+	finger := server.request("/.well-known/webfinger")
+	if finger == nil || finger.URL.Query().Get("resource") != "acct:alice@social.test" {
+		t.Fatalf("WebFinger request = %v, want a lookup of acct:alice@social.test", finger)
+	}
+	if actor := server.request("/users/alice"); actor == nil || !strings.Contains(actor.Header.Get("Accept"), "application/activity+json") {
+		t.Errorf("actor was not requested as ActivityPub")
+	}
+
+	if feed.Kind != models.FeedKindMastodon || feed.Title != "Alice Example (@alice@social.test)" {
+		t.Errorf("got %s feed %q", feed.Kind, feed.Title)
+	}
+	if feed.URL != server.URL+"/@alice" {
+		t.Errorf("URL = %q, want the profile page", feed.URL)
+	}
+	want := map[string]string{
+		"instance": server.URL,
+		"account":  "alice@social.test",
+		"actor":    server.URL + "/users/alice",
+	}
+	for key, value := range want {
+		if feed.Options[key] != value {
+			t.Errorf("option %s = %q, want %q", key, feed.Options[key], value)
+		}
+	}
+}
+
+func TestResolveMastodonProfileURL(t *testing.T) {
+	server := newFediverseServer(t, accountRoutes)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	feed, err := resolveMastodonFeed(context.Background(), server.URL+"/@alice")
+	if err != nil || feed == nil {
+		t.Fatalf("feed = %v, err = %v", feed, err)
+	}
+	if feed.Options["account"] != "alice@"+host {
+		t.Errorf("account = %q, want alice@%s", feed.Options["account"], host)
+	}
+
+	// Servers without NodeInfo aren't taken for fediverse servers
+	delete(server.routes, "/.well-known/nodeinfo")
+	if feed, err := resolveMastodonFeed(context.Background(), server.URL+"/@alice"); feed != nil || err != nil {
+		t.Errorf("feed = %v, err = %v, want neither", feed, err)
+	}
+}
+
+func TestResolveMastodonUnknownAccount(t *testing.T) {
+	newFediverseServer(t, map[string]string{})
+
+	if _, err := resolveMastodonFeed(context.Background(), "@nobody@social.test"); err == nil || !strings.Contains(err.Error(), "could not find nobody@social.test") {
+		t.Errorf("err = %v, want the account reported missing", err)
+	}
+}
+
+func TestMastodonOutbox(t *testing.T) {
+	server := newFediverseServer(t, accountRoutes)
+	options := map[string]string{
+		"instance": server.URL,
+		"account":  "alice@social.test",
+		"actor":    server.URL + "/users/alice",
+	}
+
+	posts, status, err := fetchMastodonAccount(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(posts) != 4 {
+		t.Fatalf("got %d posts with status %d, want 4", len(posts), status)
+	}
+	if server.request("/api/v1/accounts/lookup") != nil {
+		t.Error("fell back to the API although the outbox was readable")
+	}
+
+	feed := models.NewFeed(server.URL + "/@alice")
+
+	post := posts[0]
+	if post.ID != server.URL+"/users/alice/statuses/3" || post.Author != "Alice Example" {
+		t.Errorf("post = %q by %q", post.ID, post.Author)
+	}
+	article := mastodonArticle(feed, post)
+	if article.URL != server.URL+"/@alice/3" || article.ImageURL != server.URL+"/media/flame.png" {
+		t.Errorf("article URL = %q, image = %q", article.URL, article.ImageURL)
+	}
+	if !strings.HasPrefix(article.Title, "Profiling a #golang service") {
+		t.Errorf("title = %q, want the start of the text", article.Title)
+	}
+	if strings.Join(article.Categories, ",") != "golang" {
+		t.Errorf("categories = %v, want the hashtag", article.Categories)
+	}
+
+	if reply := posts[1]; reply.InReplyTo != server.URL+"/users/bob/statuses/8" {
+		t.Errorf("reply in reply to %q", reply.InReplyTo)
+	}
+
+	// Boosts reference the boosted post, which is fetched separately
+	boost := posts[2]
+	if boost.ID != server.URL+"/users/alice/statuses/10/activity" || boost.BoostedBy != "Alice Example" {
+		t.Errorf("boost = %q by %q", boost.ID, boost.BoostedBy)
+	}
+	if boost.Author != "bob@"+strings.TrimPrefix(server.URL, "http://") {
+		t.Errorf("boosted author = %q", boost.Author)
+	}
+	if !boost.Published.Equal(time.Date(2024, 2, 27, 18, 30, 0, 0, time.UTC)) {
+		t.Errorf("boost published = %v, want when it was boosted", boost.Published)
+	}
+	article = mastodonArticle(feed, boost)
+	if article.Title != "Boosted: Go 1.22 fixes the loop variable gotcha at last." || article.Description != "Boosted by Alice Example" {
+		t.Errorf("boost article = %q, %q", article.Title, article.Description)
+	}
+	if strings.Join(article.Categories, ",") != "boost" {
+		t.Errorf("categories = %v, want boost", article.Categories)
+	}
+
+	warned := mastodonArticle(feed, posts[3])
+	if warned.Title != "TV spoilers" || !strings.HasPrefix(warned.Content, "<p><strong>TV spoilers</strong></p>") {
+		t.Errorf("content warning article = %q, %q", warned.Title, warned.Content)
+	}
+	if len(warned.Enclosures) != 1 || warned.Enclosures[0].Type != "video/mp4" {
+		t.Errorf("enclosures = %+v, want the clip", warned.Enclosures)
+	}
+}
+
+func TestMastodonFallsBackToAPI(t *testing.T) {
+	server := newFediverseServer(t, accountRoutes)
+	server.statuses["/users/alice/outbox"] = http.StatusUnauthorized
+	options := map[string]string{
+		"instance": server.URL,
+		"account":  "alice@social.test",
+		"actor":    server.URL + "/users/alice",
+	}
+
+	posts, status, err := fetchMastodonAccount(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(posts) != 3 {
+		t.Fatalf("got %d posts with status %d, want 3", len(posts), status)
+	}
+
+	lookup := server.request("/api/v1/accounts/lookup")
+	if lookup == nil || lookup.URL.Query().Get("acct") != "alice@social.test" {
+		t.Fatalf("lookup = %v, want the account looked up", lookup)
+	}
+	if statuses := server.request("/api/v1/accounts/1099/statuses"); statuses == nil || statuses.URL.Query().Get("limit") != "40" {
+		t.Errorf("statuses = %v, want a page of 40", statuses)
+	}
+
+	video := posts[0]
+	if len(video.Attachments) != 1 || video.Attachments[0].MediaType != "video/mp4" || video.Attachments[0].Duration != 95 {
+		t.Errorf("attachments = %+v", video.Attachments)
+	}
+	if strings.Join(video.Tags, ",") != "golang" {
+		t.Errorf("tags = %v", video.Tags)
+	}
+
+	boost := posts[1]
+	if boost.BoostedBy != "Alice Example" || boost.Author != "bob" || boost.URL != server.URL+"/@bob/9" {
+		t.Errorf("boost = %+v", boost)
+	}
+	if boost.ID != server.URL+"/users/alice/statuses/10/activity" {
+		t.Errorf("boost ID = %q, want the boost's own", boost.ID)
+	}
+
+	if posts[2].InReplyTo != "105" {
+		t.Errorf("reply in reply to %q", posts[2].InReplyTo)
+	}
+}
+
+func TestMastodonOutboxErrorsAreNotRetried(t *testing.T) {
+	server := newFediverseServer(t, accountRoutes)
+	server.statuses["/users/alice/outbox"] = http.StatusInternalServerError
+	options := map[string]string{
+		"instance": server.URL,
+		"account":  "alice@social.test",
+		"actor":    server.URL + "/users/alice",
+	}
+
+	if _, _, err := fetchMastodonAccount(context.Background(), options); err == nil {
+		t.Fatal("expected the outbox error")
+	}
+	if server.request("/api/v1/accounts/lookup") != nil {
+		t.Error("fell back to the API for a server error")
+	}
+}
+
+func TestMastodonTag(t *testing.T) {
+	server := newFediverseServer(t, accountRoutes)
+
+	feed, err := resolveMastodonFeed(context.Background(), "#golang@social.test")
+	if err != nil || feed == nil {
+		t.Fatalf("feed = %v, err = %v", feed, err)
+	}
+	if feed.URL != server.URL+"/tags/golang" || feed.Options["instance"] != server.URL || feed.Options["tag"] != "golang" {
+		t.Errorf("feed = %s %v", feed.URL, feed.Options)
+	}
+
+	posts, _, err := fetchMastodonTag(context.Background(), feed.Options["instance"], feed.Options["tag"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 3 {
+		t.Errorf("got %d posts, want 3", len(posts))
+	}
+	if timeline := server.request("/api/v1/timelines/tag/golang"); timeline == nil || timeline.URL.Query().Get("limit") != "40" {
+		t.Errorf("timeline = %v", timeline)
+	}
+
+	if _, err := resolveMastodonFeed(context.Background(), "#@social.test"); err == nil {
+		t.Error("expected an error for a hashtag without a name")
+	}
+}
@@ -0,0 +1,142 @@
+package worker
+
+import (
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"redapplications.com/redreader/models"
+)
+
+// itemEnclosures collects an item's media from RSS enclosures, Atom enclosure
+// links, Media RSS and the iTunes podcast extension
+func itemEnclosures(parsedFeed *gofeed.Feed, item *gofeed.Item) []models.Enclosure {
+	var enclosures []models.Enclosure
+	seen := make(map[string]int)
+
+	add := func(enclosure models.Enclosure) {
+		if enclosure.URL == "" {
+			return
+		}
+		if enclosure.Type == "" {
+			enclosure.Type = mime.TypeByExtension(path.Ext(strings.SplitN(enclosure.URL, "?", 2)[0]))
+			enclosure.Type, _, _ = strings.Cut(enclosure.Type, ";")
+		}
+
+		// The same file is often listed as both an enclosure and Media RSS
+		// content, merge whatever each one knows
+		if i, ok := seen[enclosure.URL]; ok {
+			existing := &enclosures[i]
+			if existing.Type == "" {
+				existing.Type = enclosure.Type
+			}
+			if existing.Length == 0 {
+				existing.Length = enclosure.Length
+			}
+			if existing.Duration == 0 {
+				existing.Duration = enclosure.Duration
+			}
+			return
+		}
+		seen[enclosure.URL] = len(enclosures)
+		enclosures = append(enclosures, enclosure)
+	}
+
+	for _, enclosure := range item.Enclosures {
+		if enclosure == nil {
+			continue
+		}
+		length, _ := strconv.ParseInt(strings.TrimSpace(enclosure.Length), 10, 64)
+		add(models.Enclosure{URL: enclosure.URL, Type: enclosure.Type, Length: length})
+	}
+
+	if video, ok := youtubeEnclosure(item); ok {
+		add(video)
+	}
+
+	media := item.Extensions["media"]
+	for _, content := range mediaContents(media) {
+		// Flash players, like the ones YouTube lists, can't be played
+		if medium := content.Attrs["medium"]; medium == "image" || content.Attrs["type"] == "application/x-shockwave-flash" {
+			continue
+		}
+		length, _ := strconv.ParseInt(content.Attrs["fileSize"], 10, 64)
+		add(models.Enclosure{
+			URL:      content.Attrs["url"],
+			Type:     content.Attrs["type"],
+			Length:   length,
+			Duration: parseDuration(content.Attrs["duration"]),
+		})
+	}
+
+	// The iTunes extension describes the episode as a whole, which for
+	// podcasts is the audio enclosure
+	artwork := itemArtwork(parsedFeed, item)
+	duration := parseDuration(item.Custom["duration"])
+	if item.ITunesExt != nil && item.ITunesExt.Duration != "" {
+		duration = parseDuration(item.ITunesExt.Duration)
+	}
+	for i := range enclosures {
+		if !enclosures[i].IsAudio() && !enclosures[i].IsVideo() && !enclosures[i].IsYouTube() {
+			continue
+		}
+		if enclosures[i].Duration == 0 {
+			enclosures[i].Duration = duration
+		}
+		if enclosures[i].Image == "" {
+			enclosures[i].Image = artwork
+		}
+	}
+
+	return enclosures
+}
+
+// mediaContents returns the media:content elements of an item, including
+// those grouped under media:group
+func mediaContents(media map[string][]ext.Extension) []ext.Extension {
+	contents := append([]ext.Extension{}, media["content"]...)
+	for _, group := range media["group"] {
+		contents = append(contents, group.Children["content"]...)
+	}
+	return contents
+}
+
+func itemArtwork(parsedFeed *gofeed.Feed, item *gofeed.Item) string {
+	if item.ITunesExt != nil && item.ITunesExt.Image != "" {
+		return item.ITunesExt.Image
+	}
+	if thumbnails := item.Extensions["media"]["thumbnail"]; len(thumbnails) > 0 {
+		return thumbnails[0].Attrs["url"]
+	}
+	if item.Image != nil && item.Image.URL != "" {
+		return item.Image.URL
+	}
+	if parsedFeed.ITunesExt != nil && parsedFeed.ITunesExt.Image != "" {
+		return parsedFeed.ITunesExt.Image
+	}
+	if parsedFeed.Image != nil {
+		return parsedFeed.Image.URL
+	}
+	return ""
+}
+
+// parseDuration reads durations given as seconds or as [[HH:]MM:]SS
+func parseDuration(value string) int {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	total := 0.0
+	for _, part := range strings.Split(value, ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0
+		}
+		total = total*60 + n
+	}
+	return int(total)
+}
@@ -0,0 +1,172 @@
+package worker
+
+import (
+	"fmt"
+	"strconv"
+
+	"redapplications.com/redreader/models"
+	"redapplications.com/redreader/repository"
+	"redapplications.com/redreader/sanitize"
+)
+
+type migration struct {
+	name string
+	run  func() error
+}
+
+// Migrator applies one-off data migrations that have not yet been recorded
+type Migrator struct {
+	migrationRepo *repository.MigrationRepository
+	feedRepo      *repository.FeedRepository
+	articleRepo   *repository.ArticleRepository
+}
+
+func NewMigrator(migrationRepo *repository.MigrationRepository, feedRepo *repository.FeedRepository, articleRepo *repository.ArticleRepository) *Migrator {
+	return &Migrator{
+		migrationRepo: migrationRepo,
+		feedRepo:      feedRepo,
+		articleRepo:   articleRepo,
+	}
+}
+
+func (m *Migrator) migrations() []migration {
+	return []migration{
+		{name: "sanitize-article-html", run: m.sanitizeArticles},
+		{name: "hacker-news-feed-kind", run: m.setHackerNewsKind},
+		{name: "canonicalize-legacy-articles", run: m.canonicalizeLegacyArticles},
+		{name: "plain-text-article-titles", run: m.plainTextTitles},
+		{name: "hide-newsletter-addresses", run: m.feedRepo.HideNewsletterAddresses},
+	}
+}
+
+func (m *Migrator) Run() error {
+	for _, mig := range m.migrations() {
+		applied, err := m.migrationRepo.IsApplied(mig.name)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		println("Running migration:", mig.name)
+		if err := mig.run(); err != nil {
+			return fmt.Errorf("migration %s failed: %w", mig.name, err)
+		}
+		if err := m.migrationRepo.MarkApplied(mig.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sanitizeArticles cleans the HTML of articles stored before content was
+// sanitized at ingest
+func (m *Migrator) sanitizeArticles() error {
+	return m.articleRepo.ForEachArticle(func(article *models.Article) error {
+		hash := article.ContentHash
+		// Titles are left to plain-text-article-titles, which runs next
+		title := article.Title
+		sanitizeArticle(article)
+		article.Title = title
+		if article.ComputeContentHash() == hash {
+			return nil
+		}
+
+		// Only refresh the hash if there was one, so legacy articles are
+		// still matched on URL by the next fetch
+		if hash != "" {
+			article.ContentHash = article.ComputeContentHash()
+		}
+		return m.articleRepo.UpdateArticle(article)
+	})
+}
+
+// plainTextTitles undoes the escaping sanitize-article-html applied to titles,
+// which are now stored as plain text and escaped once when shown
+func (m *Migrator) plainTextTitles() error {
+	return m.articleRepo.ForEachArticle(func(article *models.Article) error {
+		title := sanitize.Text(article.Title)
+		if title == article.Title {
+			return nil
+		}
+
+		hash := article.ContentHash
+		article.Title = title
+		if hash != "" {
+			article.ContentHash = article.ComputeContentHash()
+		}
+		return m.articleRepo.UpdateArticle(article)
+	})
+}
+
+// setHackerNewsKind marks the Hacker News feed, which was stored with the
+// placeholder URL "api" before feeds had kinds
+func (m *Migrator) setHackerNewsKind() error {
+	return m.feedRepo.SetKindByURL("api", models.FeedKindHackerNews)
+}
+
+// canonicalizeLegacyArticles brings articles stored before GUIDs existed in
+// line with how items are matched now. Their URLs are canonicalized so the
+// URL fallback in FindArticle matches them, and the next fetch of their feed
+// fills in the GUID. Hacker News stories get theirs from the story ID right
+// away. A legacy article whose item was already stored again with a GUID is
+// a duplicate and is removed. Everything is worked out from what is stored,
+// so startup never waits on the feeds themselves.
+func (m *Migrator) canonicalizeLegacyArticles() error {
+	type legacyArticle struct {
+		id           string
+		feedID       string
+		url          string
+		hackerNewsID int64
+	}
+
+	// Collected first so articles aren't changed while the cursor is open
+	var legacy []legacyArticle
+	err := m.articleRepo.ForEachArticle(func(article *models.Article) error {
+		if article.GUID == "" {
+			legacy = append(legacy, legacyArticle{
+				id:           article.ID,
+				feedID:       article.FeedID,
+				url:          article.URL,
+				hackerNewsID: article.HackerNewsID,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, article := range legacy {
+		url := CanonicalizeURL(article.url)
+		var guid string
+		if article.hackerNewsID != 0 {
+			guid = strconv.FormatInt(article.hackerNewsID, 10)
+		}
+
+		var twin *models.Article
+		if guid != "" {
+			twin, err = m.articleRepo.FindArticleByGUID(article.feedID, guid)
+		} else if url != "" {
+			twin, err = m.articleRepo.FindIdentifiedArticleByURL(article.feedID, url)
+		}
+		if err != nil {
+			return err
+		}
+		if twin != nil && twin.ID != article.id {
+			if err := m.articleRepo.DeleteArticle(article.id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if url == article.url && guid == "" {
+			continue
+		}
+		if err := m.articleRepo.SetIdentity(article.id, url, guid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"redapplications.com/redreader/mailin"
+	"redapplications.com/redreader/models"
+	"redapplications.com/redreader/repository"
+)
+
+// NewsletterInbox files mail sent to newsletter addresses as articles in
+// each address's feed. Addresses live on MAIL_DOMAIN, and no mail is
+// accepted while that isn't set.
+type NewsletterInbox struct {
+	newsletterRepo *repository.NewsletterRepository
+	articleRepo    *repository.ArticleRepository
+	domain         string
+	publicURL      string
+}
+
+func NewNewsletterInbox(newsletterRepo *repository.NewsletterRepository, articleRepo *repository.ArticleRepository) *NewsletterInbox {
+	return &NewsletterInbox{
+		newsletterRepo: newsletterRepo,
+		articleRepo:    articleRepo,
+		domain:         strings.ToLower(strings.TrimSpace(os.Getenv("MAIL_DOMAIN"))),
+		publicURL:      strings.TrimRight(os.Getenv("PUBLIC_URL"), "/"),
+	}
+}
+
+func (i *NewsletterInbox) Enabled() bool {
+	return i.domain != ""
+}
+
+// Domain is the mail domain newsletter addresses are created on
+func (i *NewsletterInbox) Domain() string {
+	return i.domain
+}
+
+// address looks up the active newsletter address mail to recipient is for
+func (i *NewsletterInbox) address(recipient string) (*models.NewsletterAddress, error) {
+	localPart, domain, ok := strings.Cut(strings.ToLower(recipient), "@")
+	if !ok || !i.Enabled() || domain != i.domain {
+		return nil, mailin.ErrUnknownRecipient
+	}
+
+	address, err := i.newsletterRepo.GetAddressByLocalPart(localPart)
+	if err != nil {
+		return nil, err
+	}
+	if address == nil || address.Revoked {
+		return nil, mailin.ErrUnknownRecipient
+	}
+	return address, nil
+}
+
+func (i *NewsletterInbox) Accept(recipient string) error {
+	_, err := i.address(recipient)
+	return err
+}
+
+func (i *NewsletterInbox) Deliver(recipient string, message *mailin.Message) error {
+	address, err := i.address(recipient)
+	if err != nil {
+		return err
+	}
+
+	article := newsletterArticle(address.FeedID.Hex(), message)
+
+	// Senders retry and mailing lists duplicate, so a message is only filed once
+	existing, err := i.articleRepo.FindArticle(article.FeedID, article.GUID, "")
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return nil
+	}
+
+	// There is no web copy to link to, so articles link to themselves
+	article.URL = i.publicURL + "/article/" + article.ID
+	if _, err := upsertArticle(i.articleRepo, article); err != nil {
+		return err
+	}
+	return i.newsletterRepo.UpdateLastReceived(address.ID, time.Now())
+}
+
+func newsletterArticle(feedID string, message *mailin.Message) *models.Article {
+	article := models.NewArticle(feedID)
+	// Messages without an ID are told apart by their content, so a retried
+	// delivery still finds the copy filed the first time
+	article.GUID = message.ID
+	if article.GUID == "" {
+		sum := sha256.Sum256([]byte(message.FromAddress + "\n" + message.Subject + "\n" + message.Date.String() + "\n" + message.HTML + "\n" + message.Text))
+		article.GUID = hex.EncodeToString(sum[:])
+	}
+	article.GUID = "mail:" + article.GUID
+
+	article.Title = message.Subject
+	if article.Title == "" {
+		article.Title = fmt.Sprintf("Newsletter from %s", message.From)
+	}
+	article.Author = message.From
+	article.PublishedAt = message.Date
+	if article.PublishedAt.IsZero() || article.PublishedAt.After(time.Now()) {
+		article.PublishedAt = time.Now()
+	}
+
+	article.Content = message.HTML
+	if article.Content == "" {
+		article.Content = textToHTML(message.Text)
+	}
+	// Inline images are data: URIs of up to several megabytes, too big to
+	// repeat on every card, so only a remote image becomes the lead image
+	article.ImageURL = firstContentImage(article.Content)
+	return article
+}
+
+// newsletterSource stands in for newsletter feeds, whose issues arrive by
+// mail through NewsletterInbox. There is nothing to poll, so fetching one
+// finds no new articles.
+type newsletterSource struct{}
+
+func (newsletterSource) Fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	return nil, nil
+}
+
+func (newsletterSource) PushOnly() bool {
+	return true
+}
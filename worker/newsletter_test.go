@@ -0,0 +1,59 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"redapplications.com/redreader/mailin"
+)
+
+func TestNewsletterArticle(t *testing.T) {
+	date := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		message *mailin.Message
+		guid    string
+		image   string
+	}{
+		{
+			name:    "uses the Message-ID",
+			message: &mailin.Message{ID: "abc@example.com", Subject: "Issue 1", Date: date, HTML: `<img src="https://example.com/hero.png">`},
+			guid:    "mail:abc@example.com",
+			image:   "https://example.com/hero.png",
+		},
+		{
+			name:    "leaves inline images out of the lead image",
+			message: &mailin.Message{ID: "def@example.com", Subject: "Issue 2", Date: date, HTML: `<img src="data:image/png;base64,iVBORw0KGgo="><img src="https://example.com/second.png">`},
+			guid:    "mail:def@example.com",
+			image:   "https://example.com/second.png",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			article := newsletterArticle("feed", test.message)
+			if article.GUID != test.guid {
+				t.Errorf("GUID = %q, want %q", article.GUID, test.guid)
+			}
+			if article.ImageURL != test.image {
+				t.Errorf("image = %q, want %q", article.ImageURL, test.image)
+			}
+		})
+	}
+}
+
+func TestNewsletterArticleWithoutMessageID(t *testing.T) {
+	message := &mailin.Message{FromAddress: "digest@example.com", Subject: "Weekly", Text: "First issue"}
+	first := newsletterArticle("feed", message)
+	if again := newsletterArticle("feed", message); again.GUID != first.GUID {
+		t.Errorf("GUIDs %q and %q differ for a retried delivery", first.GUID, again.GUID)
+	}
+
+	next := newsletterArticle("feed", &mailin.Message{FromAddress: "digest@example.com", Subject: "Weekly", Text: "Second issue"})
+	if next.GUID == first.GUID {
+		t.Errorf("two issues with the same subject share GUID %q", first.GUID)
+	}
+	if first.Title != "Weekly" || first.Content != textToHTML("First issue") {
+		t.Errorf("article = %q, %q", first.Title, first.Content)
+	}
+}
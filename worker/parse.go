@@ -0,0 +1,311 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	maxFeedSize = 20 << 20
+)
+
+// ErrNotAFeed is returned for documents that aren't RSS, Atom or JSON feeds
+var ErrNotAFeed = errors.New("not an RSS, Atom or JSON feed")
+
+var xmlDeclaration = regexp.MustCompile(`^\s*<\?xml[^>]*\?>`)
+var xmlDeclaredEncoding = regexp.MustCompile(`encoding\s*=\s*["']([^"']*)["']`)
+
+// parseFeed parses a feed document, first repairing the byte order marks and
+// mislabelled character sets common in feeds found in the wild. contentType is
+// the Content-Type the document was served with, if known.
+func parseFeed(body []byte, contentType string) (*gofeed.Feed, error) {
+	body = normalizeEncoding(body, contentType)
+
+	parsedFeed, err := newFeedParser().Parse(bytes.NewReader(body))
+	if errors.Is(err, gofeed.ErrFeedTypeNotDetected) {
+		if looksLikeHTML(body) {
+			return nil, fmt.Errorf("%w: the address returned a web page", ErrNotAFeed)
+		}
+		return nil, ErrNotAFeed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s feed: %w", detectedFeedType(body), err)
+	}
+
+	if parsedFeed.FeedType == "atom" {
+		resolveAtomLinks(parsedFeed, body)
+	}
+	return parsedFeed, nil
+}
+
+// FetchFeed downloads and parses the feed at feedURL, for checking a feed
+// before it is added
+func FetchFeed(ctx context.Context, feedURL string) (*gofeed.Feed, error) {
+	body, _, err := fetchDocument(ctx, feedURL)
+	if err != nil {
+		return nil, err
+	}
+	return parseFeed(body, "")
+}
+
+// normalizeEncoding converts a feed to UTF-8 when it can tell the document
+// isn't, leaving documents that correctly declare another encoding to the
+// parser
+func normalizeEncoding(body []byte, contentType string) []byte {
+	switch {
+	case bytes.HasPrefix(body, []byte{0xEF, 0xBB, 0xBF}):
+		body = body[3:]
+	case bytes.HasPrefix(body, []byte{0xFE, 0xFF}):
+		return transcode(body[2:], "utf-16be")
+	case bytes.HasPrefix(body, []byte{0xFF, 0xFE}):
+		return transcode(body[2:], "utf-16le")
+	}
+
+	declared := ""
+	if declaration := xmlDeclaration.Find(body); declaration != nil {
+		if match := xmlDeclaredEncoding.FindSubmatch(declaration); match != nil {
+			declared = strings.ToLower(string(match[1]))
+		}
+	}
+	if declared != "" && declared != "utf-8" && declared != "utf8" {
+		return body
+	}
+
+	// Without a declaration the server's charset applies
+	if declared == "" && contentType != "" {
+		if _, params, err := mime.ParseMediaType(contentType); err == nil {
+			label := strings.ToLower(params["charset"])
+			if label != "" && label != "utf-8" && label != "utf8" {
+				return transcode(body, label)
+			}
+		}
+	}
+
+	// Documents claiming to be UTF-8 that aren't are nearly always Windows-1252
+	if !utf8.Valid(body) {
+		return transcode(body, "windows-1252")
+	}
+	return body
+}
+
+// transcode converts body from the named encoding to UTF-8 and updates its
+// XML declaration to match
+func transcode(body []byte, label string) []byte {
+	encoding, _ := charset.Lookup(label)
+	if encoding == nil {
+		return body
+	}
+
+	converted, err := io.ReadAll(encoding.NewDecoder().Reader(bytes.NewReader(body)))
+	if err != nil {
+		return body
+	}
+	converted = bytes.TrimPrefix(converted, []byte("\uFEFF"))
+
+	return xmlDeclaration.ReplaceAllFunc(converted, func(declaration []byte) []byte {
+		return xmlDeclaredEncoding.ReplaceAll(declaration, []byte(`encoding="utf-8"`))
+	})
+}
+
+func detectedFeedType(body []byte) string {
+	switch gofeed.DetectFeedType(bytes.NewReader(body)) {
+	case gofeed.FeedTypeRSS:
+		return "RSS"
+	case gofeed.FeedTypeAtom:
+		return "Atom"
+	case gofeed.FeedTypeJSON:
+		return "JSON"
+	}
+	return "unknown"
+}
+
+func looksLikeHTML(body []byte) bool {
+	start := bytes.ToLower(bytes.TrimSpace(body[:min(len(body), 512)]))
+	return bytes.HasPrefix(start, []byte("<!doctype html")) || bytes.Contains(start, []byte("<html"))
+}
+
+// resolveAtomLinks replaces the feed and entry links with ones resolved
+// against the xml:base in effect where they appear, as the parser doesn't
+// reliably apply it to links
+func resolveAtomLinks(parsedFeed *gofeed.Feed, body []byte) {
+	feedLink, entryLinks := atomAlternateLinks(body)
+
+	if feedLink != "" {
+		parsedFeed.Link = feedLink
+	}
+
+	if len(entryLinks) != len(parsedFeed.Items) {
+		return
+	}
+	for i, item := range parsedFeed.Items {
+		if item != nil && entryLinks[i] != "" {
+			item.Link = entryLinks[i]
+		}
+	}
+}
+
+// atomAlternateLinks returns the alternate link of the feed and of each
+// entry, in document order, resolved against their xml:base. Links without a
+// base are left empty.
+func atomAlternateLinks(body []byte) (string, []string) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	decoder.CharsetReader = charset.NewReaderLabel
+
+	var feedLink string
+	var entryLinks []string
+	var stack []*url.URL
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return feedLink, entryLinks
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			var base *url.URL
+			if len(stack) > 0 {
+				base = stack[len(stack)-1]
+			}
+			for _, attr := range element.Attr {
+				if attr.Name.Local != "base" || (attr.Name.Space != "xml" && attr.Name.Space != "http://www.w3.org/XML/1998/namespace") {
+					continue
+				}
+				if base != nil {
+					base, err = base.Parse(attr.Value)
+				} else {
+					base, err = url.Parse(attr.Value)
+				}
+				if err != nil {
+					base = nil
+				}
+			}
+			stack = append(stack, base)
+
+			if element.Name.Local == "entry" && len(stack) == 2 {
+				entryLinks = append(entryLinks, "")
+			}
+			if element.Name.Local != "link" || base == nil || !isAlternateLink(element) {
+				continue
+			}
+
+			href := ""
+			for _, attr := range element.Attr {
+				if attr.Name.Local == "href" && attr.Name.Space == "" {
+					href = attr.Value
+				}
+			}
+			resolved, err := base.Parse(href)
+			if href == "" || err != nil {
+				continue
+			}
+
+			switch {
+			case len(stack) == 2 && feedLink == "":
+				feedLink = resolved.String()
+			case len(stack) == 3 && len(entryLinks) > 0 && entryLinks[len(entryLinks)-1] == "":
+				entryLinks[len(entryLinks)-1] = resolved.String()
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+}
+
+func isAlternateLink(element xml.StartElement) bool {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == "rel" && attr.Name.Space == "" {
+			return attr.Value == "alternate"
+		}
+	}
+	return true
+}
+
+// Layouts seen in feeds whose dates the parser rejects, tried after the
+// date has been cleaned up
+var looseDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05",
+	"Jan 2, 2006 15:04:05",
+	"Jan 2, 2006",
+	"January 2, 2006",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+var dateComment = regexp.MustCompile(`\s*\([^)]*\)\s*$`)
+
+// Feeds from before syndication existed are assumed to have broken dates
+var earliestPublishDate = time.Date(1995, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// itemPublished returns when an item was published, falling back through
+// the dates a feed might carry and finally to now for items with no usable
+// date. Dates in the future are clamped to now.
+func itemPublished(item *gofeed.Item, now time.Time) time.Time {
+	candidates := []*time.Time{item.PublishedParsed, item.UpdatedParsed}
+	for _, raw := range []string{item.Published, item.Updated} {
+		if parsed, ok := parseLooseDate(raw); ok {
+			candidates = append(candidates, &parsed)
+		}
+	}
+	if item.DublinCoreExt != nil {
+		for _, raw := range item.DublinCoreExt.Date {
+			if parsed, ok := parseLooseDate(raw); ok {
+				candidates = append(candidates, &parsed)
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if candidate == nil || candidate.Before(earliestPublishDate) {
+			continue
+		}
+		if candidate.After(now) {
+			return now
+		}
+		return *candidate
+	}
+	return now
+}
+
+func parseLooseDate(raw string) (time.Time, bool) {
+	cleaned := dateComment.ReplaceAllString(strings.TrimSpace(raw), "")
+	cleaned = strings.Join(strings.Fields(cleaned), " ")
+	cleaned = strings.Replace(cleaned, "Sept ", "Sep ", 1)
+	cleaned = strings.Replace(cleaned, " UT", " UTC", 1)
+	cleaned = strings.Replace(cleaned, " UTCC", " UTC", 1)
+	if cleaned == "" {
+		return time.Time{}, false
+	}
+
+	for _, layout := range looseDateLayouts {
+		if parsed, err := time.Parse(layout, cleaned); err == nil {
+			return parsed, true
+		}
+	}
+	return time.Time{}, false
+}
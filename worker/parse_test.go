@@ -0,0 +1,212 @@
+package worker
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func parseFixture(t *testing.T, name string) *gofeed.Feed {
+	t.Helper()
+	parsedFeed, err := parseFeed(readFixture(t, name), "")
+	if err != nil {
+		t.Fatalf("parsing %s: %v", name, err)
+	}
+	return parsedFeed
+}
+
+func TestParseFeedEncodings(t *testing.T) {
+	tests := []struct {
+		fixture string
+		title   string
+		item    string
+	}{
+		{"feeds/bom.xml", "Café with a BOM", "Crème brûlée"},
+		{"feeds/utf16le.xml", "Café in UTF-16", "“Quoted” — naïve"},
+		{"feeds/utf16be.xml", "Café in UTF-16", "“Quoted” — naïve"},
+		{"feeds/windows1252.xml", "Café mislabelled", "“Smart quotes” – €5"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			parsedFeed := parseFixture(t, test.fixture)
+			if parsedFeed.Title != test.title {
+				t.Errorf("title = %q, want %q", parsedFeed.Title, test.title)
+			}
+			if len(parsedFeed.Items) != 1 || parsedFeed.Items[0].Title != test.item {
+				t.Fatalf("items = %+v, want one titled %q", parsedFeed.Items, test.item)
+			}
+		})
+	}
+}
+
+func TestParseFeedJSONFeed11(t *testing.T) {
+	parsedFeed := parseFixture(t, "feeds/jsonfeed11.json")
+	if len(parsedFeed.Items) != 2 {
+		t.Fatalf("got %d items, want 2", len(parsedFeed.Items))
+	}
+
+	text := parsedFeed.Items[0]
+	if want := "<p>First paragraph with &lt;angle&gt; brackets.</p>\n<p>Second paragraph.</p>"; text.Content != want {
+		t.Errorf("content_text = %q, want %q", text.Content, want)
+	}
+	if text.Description != "A summary &amp; more" {
+		t.Errorf("summary = %q, want it escaped", text.Description)
+	}
+	if len(text.Authors) != 1 || text.Authors[0].Name != "Feed Author" {
+		t.Errorf("authors = %+v, want the feed's author", text.Authors)
+	}
+
+	linked := parsedFeed.Items[1]
+	if linked.Link != "https://elsewhere.example.net/story" {
+		t.Errorf("link = %q, want the external_url", linked.Link)
+	}
+	if len(linked.Authors) != 1 || linked.Authors[0].Name != "Item Author" {
+		t.Errorf("authors = %+v, want the item's own author", linked.Authors)
+	}
+	if len(linked.Enclosures) != 1 || linked.Enclosures[0].Length != "123456" {
+		t.Errorf("enclosures = %+v, want a length of 123456", linked.Enclosures)
+	}
+	if linked.Custom["duration"] != "1800" {
+		t.Errorf("duration = %q, want 1800", linked.Custom["duration"])
+	}
+}
+
+func TestParseFeedAtomContentTypes(t *testing.T) {
+	parsedFeed := parseFixture(t, "feeds/atom_content.xml")
+
+	want := map[string]struct {
+		content string
+		link    string
+	}{
+		"Text":                  {"<p>Tom &lt;b&gt;&amp;&lt;/b&gt; Jerry</p>", "https://example.com/text"},
+		"HTML":                  {"<p>Escaped <b>markup</b></p>", "https://example.com/html"},
+		"XHTML":                 {"<p>Inline <em>markup</em></p>", "https://example.com/xhtml"},
+		"Plain text media type": {"<p>1 &lt; 2</p>", "https://example.com/plain"},
+		"Binary":                {"", "https://example.com/binary"},
+		"Out of line":           {"", "https://example.com/out-of-line"},
+	}
+	if len(parsedFeed.Items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(parsedFeed.Items), len(want))
+	}
+	for _, item := range parsedFeed.Items {
+		expected, ok := want[item.Title]
+		if !ok {
+			t.Errorf("unexpected item %q", item.Title)
+			continue
+		}
+		if item.Content != expected.content {
+			t.Errorf("%s: content = %q, want %q", item.Title, item.Content, expected.content)
+		}
+		if item.Link != expected.link {
+			t.Errorf("%s: link = %q, want %q", item.Title, item.Link, expected.link)
+		}
+	}
+}
+
+func TestParseFeedXMLBase(t *testing.T) {
+	parsedFeed := parseFixture(t, "feeds/xml_base.xml")
+	if parsedFeed.Link != "https://example.com/blog/" {
+		t.Errorf("feed link = %q, want it resolved against the feed's base", parsedFeed.Link)
+	}
+
+	want := []string{
+		"https://example.com/blog/posts/one",
+		"https://example.com/archive/2024/two",
+		"https://other.example.net/three",
+	}
+	if len(parsedFeed.Items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(parsedFeed.Items), len(want))
+	}
+	for i, item := range parsedFeed.Items {
+		if item.Link != want[i] {
+			t.Errorf("%s: link = %q, want %q", item.Title, item.Link, want[i])
+		}
+	}
+}
+
+func TestParseFeedRejectsWebPages(t *testing.T) {
+	_, err := parseFeed([]byte("<!DOCTYPE html><html><body>Hello</body></html>"), "text/html")
+	if err == nil || !strings.Contains(err.Error(), "web page") {
+		t.Fatalf("err = %v, want ErrNotAFeed for a web page", err)
+	}
+}
+
+func TestNormalizeEncoding(t *testing.T) {
+	latin1 := []byte("<rss><channel><title>Caf\xe9</title></channel></rss>")
+	declared1252 := []byte(`<?xml version="1.0" encoding="windows-1252"?><rss><channel><title>Caf` + "\xe9" + `</title></channel></rss>`)
+
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		contains    string
+		unchanged   bool
+	}{
+		{name: "strips a UTF-8 BOM", body: readFixture(t, "feeds/bom.xml"), contains: "Café with a BOM"},
+		{name: "decodes UTF-16LE", body: readFixture(t, "feeds/utf16le.xml"), contains: `encoding="utf-8"`},
+		{name: "decodes UTF-16BE", body: readFixture(t, "feeds/utf16be.xml"), contains: "“Quoted” — naïve"},
+		{name: "repairs mislabelled Windows-1252", body: readFixture(t, "feeds/windows1252.xml"), contains: "“Smart quotes” – €5"},
+		{name: "uses the served charset without a declaration", body: latin1, contentType: "application/rss+xml; charset=ISO-8859-1", contains: "Café"},
+		{name: "leaves declared encodings to the parser", body: declared1252, unchanged: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			normalized := normalizeEncoding(test.body, test.contentType)
+			if test.unchanged {
+				if !bytes.Equal(normalized, test.body) {
+					t.Errorf("body was changed to %q", normalized)
+				}
+				return
+			}
+			if !utf8.Valid(normalized) {
+				t.Fatalf("result is not UTF-8: %q", normalized)
+			}
+			if bytes.HasPrefix(normalized, []byte{0xEF, 0xBB, 0xBF}) {
+				t.Errorf("result still starts with a BOM")
+			}
+			if !strings.Contains(string(normalized), test.contains) {
+				t.Errorf("result %q does not contain %q", normalized, test.contains)
+			}
+		})
+	}
+}
+
+func TestItemPublished(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	parsedFeed := parseFixture(t, "feeds/broken_dates.xml")
+
+	want := map[string]time.Time{
+		"ut":      time.Date(2023, 9, 5, 8, 30, 0, 0, time.UTC),
+		"sept":    time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC),
+		"comment": time.Date(2023, 9, 5, 6, 30, 0, 0, time.UTC),
+		"dc":      time.Date(2023, 9, 5, 8, 30, 0, 0, time.UTC),
+		"epoch":   now,
+		"future":  now,
+		"garbage": now,
+	}
+	if len(parsedFeed.Items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(parsedFeed.Items), len(want))
+	}
+	for _, item := range parsedFeed.Items {
+		if got := itemPublished(item, now); !got.Equal(want[item.GUID]) {
+			t.Errorf("%s: published = %v, want %v", item.Title, got, want[item.GUID])
+		}
+	}
+}
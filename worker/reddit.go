@@ -0,0 +1,287 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"redapplications.com/redreader/models"
+	"redapplications.com/redreader/repository"
+	"redapplications.com/redreader/sanitize"
+)
+
+const (
+	redditURL           = "https://www.reddit.com"
+	redditListingLimit  = 50
+	redditFetchInterval = 30 * time.Minute
+	redditDefaultSort   = "hot"
+)
+
+var redditSorts = map[string]bool{"hot": true, "new": true, "top": true, "rising": true, "controversial": true}
+var redditTimes = map[string]bool{"hour": true, "day": true, "week": true, "month": true, "year": true, "all": true}
+
+// redditSource imports posts from the public JSON listings of subreddits,
+// multireddits and users, which carry the scores, flair, self-text and
+// galleries that Reddit's RSS feeds leave out
+type redditSource struct {
+	articleRepo *repository.ArticleRepository
+	baseURL     string
+}
+
+func newRedditSource(articleRepo *repository.ArticleRepository) *redditSource {
+	return &redditSource{articleRepo: articleRepo, baseURL: redditURL}
+}
+
+func (s *redditSource) Options() []SourceOption {
+	return []SourceOption{
+		{Name: "sort", Label: "Sort", Help: "hot, new, top, rising or controversial"},
+		{Name: "time", Label: "Time range", Help: "For top and controversial: hour, day, week, month, year or all"},
+		{Name: "min_score", Label: "Minimum score", Help: "Skip posts with a lower score"},
+	}
+}
+
+type redditListing struct {
+	Data struct {
+		Children []struct {
+			Kind string     `json:"kind"`
+			Data redditPost `json:"data"`
+		} `json:"children"`
+	} `json:"data"`
+}
+
+type redditPost struct {
+	Name         string  `json:"name"`
+	Title        string  `json:"title"`
+	Author       string  `json:"author"`
+	Permalink    string  `json:"permalink"`
+	URL          string  `json:"url"`
+	IsSelf       bool    `json:"is_self"`
+	SelftextHTML string  `json:"selftext_html"`
+	Score        int     `json:"score"`
+	NumComments  int     `json:"num_comments"`
+	Flair        string  `json:"link_flair_text"`
+	Subreddit    string  `json:"subreddit_name_prefixed"`
+	CreatedUTC   float64 `json:"created_utc"`
+	PostHint     string  `json:"post_hint"`
+	Thumbnail    string  `json:"thumbnail"`
+	Stickied     bool    `json:"stickied"`
+	IsGallery    bool    `json:"is_gallery"`
+	GalleryData  *struct {
+		Items []struct {
+			MediaID string `json:"media_id"`
+			Caption string `json:"caption"`
+		} `json:"items"`
+	} `json:"gallery_data"`
+	MediaMetadata map[string]struct {
+		Status string `json:"status"`
+		Source struct {
+			URL string `json:"u"`
+			GIF string `json:"gif"`
+		} `json:"s"`
+	} `json:"media_metadata"`
+	Preview *struct {
+		Images []struct {
+			Source struct {
+				URL string `json:"url"`
+			} `json:"source"`
+		} `json:"images"`
+	} `json:"preview"`
+	Media *struct {
+		RedditVideo *struct {
+			FallbackURL string `json:"fallback_url"`
+			Duration    int    `json:"duration"`
+		} `json:"reddit_video"`
+	} `json:"media"`
+}
+
+// listingURL builds the JSON listing address for the feed's options
+func (s *redditSource) listingURL(options map[string]string) (string, error) {
+	listing := options["listing"]
+	if listing == "" {
+		return "", fmt.Errorf("reddit feed has no listing")
+	}
+
+	sort := strings.ToLower(options["sort"])
+	if !redditSorts[sort] {
+		sort = redditDefaultSort
+	}
+
+	query := url.Values{}
+	query.Set("raw_json", "1")
+	query.Set("limit", strconv.Itoa(redditListingLimit))
+	if t := strings.ToLower(options["time"]); redditTimes[t] && (sort == "top" || sort == "controversial") {
+		query.Set("t", t)
+	}
+
+	// User listings take the sort as a parameter rather than a path
+	if strings.HasPrefix(listing, "/user/") && !strings.Contains(listing, "/m/") {
+		query.Set("sort", sort)
+		return s.baseURL + listing + ".json?" + query.Encode(), nil
+	}
+	return s.baseURL + listing + "/" + sort + ".json?" + query.Encode(), nil
+}
+
+func (s *redditSource) Fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	posts, err := s.posts(ctx, feed.Options, fetchLog)
+	if err != nil {
+		return nil, err
+	}
+	feed.FetchInterval = redditFetchInterval
+
+	var created []*models.Article
+	for _, post := range posts {
+		article := redditArticle(feed, post)
+		result, err := upsertArticle(s.articleRepo, article)
+		if err != nil {
+			return created, err
+		}
+		switch result {
+		case articleCreated:
+			created = append(created, article)
+			fetchLog.NewArticles++
+		case articleUpdated:
+			fetchLog.UpdatedArticles++
+		}
+	}
+
+	return created, nil
+}
+
+// posts downloads the feed's listing and returns the posts worth importing,
+// leaving out comments, pinned posts and those under the minimum score
+func (s *redditSource) posts(ctx context.Context, options map[string]string, fetchLog *models.FetchLog) ([]redditPost, error) {
+	listingURL, err := s.listingURL(options)
+	if err != nil {
+		return nil, err
+	}
+	minScore, _ := strconv.Atoi(options["min_score"])
+
+	var listing redditListing
+	fetchLog.StatusCode, err = getJSON(ctx, listingURL, &listing)
+	if err != nil {
+		return nil, err
+	}
+	fetchLog.ItemCount = len(listing.Data.Children)
+
+	var posts []redditPost
+	for _, child := range listing.Data.Children {
+		if child.Kind != "t3" || child.Data.Stickied || child.Data.Score < minScore {
+			continue
+		}
+		posts = append(posts, child.Data)
+	}
+	return posts, nil
+}
+
+func redditArticle(feed *models.Feed, post redditPost) *models.Article {
+	article := models.NewArticle(feed.ID.Hex())
+	article.GUID = post.Name
+	article.Title = post.Title
+	article.Author = "u/" + post.Author
+	article.CommentsURL = redditURL + post.Permalink
+	article.PublishedAt = time.Unix(int64(post.CreatedUTC), 0)
+
+	// Self posts and galleries are read on Reddit, link posts at their link
+	article.URL = article.CommentsURL
+	if !post.IsSelf && !post.IsGallery && post.URL != "" {
+		article.URL = CanonicalizeURL(post.URL)
+	}
+
+	article.Description = fmt.Sprintf("Score: %d | Comments: %d | %s", post.Score, post.NumComments, post.Subreddit)
+	if post.Flair != "" {
+		article.Description += " | " + post.Flair
+	}
+	article.Categories = models.NormalizeTags([]string{post.Flair, post.Subreddit})
+
+	var content strings.Builder
+	content.WriteString(post.SelftextHTML)
+	if post.GalleryData != nil {
+		for _, item := range post.GalleryData.Items {
+			media, ok := post.MediaMetadata[item.MediaID]
+			if !ok || media.Status != "valid" {
+				continue
+			}
+			src := media.Source.URL
+			if src == "" {
+				src = media.Source.GIF
+			}
+			fmt.Fprintf(&content, `<figure><img src="%s" alt="%s"><figcaption>%s</figcaption></figure>`,
+				html.EscapeString(src), html.EscapeString(item.Caption), html.EscapeString(item.Caption))
+			if article.ImageURL == "" {
+				article.ImageURL = src
+			}
+		}
+	}
+	if post.PostHint == "image" && post.URL != "" {
+		fmt.Fprintf(&content, `<p><img src="%s" alt=""></p>`, html.EscapeString(post.URL))
+		article.ImageURL = post.URL
+	}
+	article.Content = sanitize.ResolveURLs(content.String(), article.CommentsURL)
+
+	if article.ImageURL == "" && post.Preview != nil && len(post.Preview.Images) > 0 {
+		article.ImageURL = post.Preview.Images[0].Source.URL
+	}
+	if article.ImageURL == "" && strings.HasPrefix(post.Thumbnail, "http") {
+		article.ImageURL = post.Thumbnail
+	}
+
+	if post.Media != nil && post.Media.RedditVideo != nil {
+		article.Enclosures = []models.Enclosure{{
+			URL:      post.Media.RedditVideo.FallbackURL,
+			Type:     "video/mp4",
+			Duration: post.Media.RedditVideo.Duration,
+			Image:    article.ImageURL,
+		}}
+	}
+
+	return article
+}
+
+// resolveRedditFeed recognises subreddit, multireddit and user addresses
+// such as https://www.reddit.com/r/golang/top/?t=week
+func resolveRedditFeed(ctx context.Context, input string) (*models.Feed, error) {
+	parsed, err := url.Parse(input)
+	if err != nil {
+		return nil, nil
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if host != "reddit.com" && !strings.HasSuffix(host, ".reddit.com") {
+		return nil, nil
+	}
+
+	segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	var listing, sort, title string
+	switch {
+	case len(segments) >= 2 && segments[0] == "r":
+		listing, title = "/r/"+segments[1], "r/"+segments[1]
+		if len(segments) >= 3 {
+			sort = segments[2]
+		}
+	case len(segments) >= 4 && (segments[0] == "user" || segments[0] == "u") && segments[2] == "m":
+		listing, title = "/user/"+segments[1]+"/m/"+segments[3], "u/"+segments[1]+"/m/"+segments[3]
+		if len(segments) >= 5 {
+			sort = segments[4]
+		}
+	case len(segments) >= 2 && (segments[0] == "user" || segments[0] == "u"):
+		listing, title = "/user/"+segments[1]+"/submitted", "u/"+segments[1]
+		sort = parsed.Query().Get("sort")
+	default:
+		return nil, nil
+	}
+	if strings.HasSuffix(sort, ".json") || !redditSorts[sort] {
+		sort = redditDefaultSort
+	}
+
+	feed := models.NewFeed(redditURL + listing + "/")
+	feed.Kind = models.FeedKindReddit
+	feed.Title = title
+	feed.Options = map[string]string{"listing": listing, "sort": sort}
+	if t := parsed.Query().Get("t"); redditTimes[t] {
+		feed.Options["time"] = t
+	}
+	return feed, nil
+}
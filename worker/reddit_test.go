@@ -0,0 +1,324 @@
+package worker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"redapplications.com/redreader/models"
+)
+
+// newRedditTestServer serves the recorded listings in testdata/reddit by
+// listing path, recording the query each request was made with
+func newRedditTestServer(t *testing.T, listings map[string]string) (*redditSource, map[string]url.Values) {
+	t.Helper()
+	queries := make(map[string]url.Values)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fixture, ok := listings[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		queries[r.URL.Path] = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(readFixture(t, "reddit/"+fixture))
+	}))
+	t.Cleanup(server.Close)
+
+	return &redditSource{baseURL: server.URL}, queries
+}
+
+func TestRedditListingURL(t *testing.T) {
+	source := &redditSource{baseURL: "http://reddit.test"}
+
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    string
+	}{
+		{
+			name:    "subreddit with the default sort",
+			options: map[string]string{"listing": "/r/golang"},
+			want:    "http://reddit.test/r/golang/hot.json?limit=50&raw_json=1",
+		},
+		{
+			name:    "top of the week",
+			options: map[string]string{"listing": "/r/golang", "sort": "TOP", "time": "week"},
+			want:    "http://reddit.test/r/golang/top.json?limit=50&raw_json=1&t=week",
+		},
+		{
+			name:    "time range ignored for new",
+			options: map[string]string{"listing": "/r/golang", "sort": "new", "time": "week"},
+			want:    "http://reddit.test/r/golang/new.json?limit=50&raw_json=1",
+		},
+		{
+			name:    "unknown sort",
+			options: map[string]string{"listing": "/r/golang", "sort": "best"},
+			want:    "http://reddit.test/r/golang/hot.json?limit=50&raw_json=1",
+		},
+		{
+			name:    "user sort is a parameter",
+			options: map[string]string{"listing": "/user/spez/submitted", "sort": "new"},
+			want:    "http://reddit.test/user/spez/submitted.json?limit=50&raw_json=1&sort=new",
+		},
+		{
+			name:    "multireddit sort is a path",
+			options: map[string]string{"listing": "/user/someone/m/langs", "sort": "rising"},
+			want:    "http://reddit.test/user/someone/m/langs/rising.json?limit=50&raw_json=1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := source.listingURL(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	if _, err := source.listingURL(map[string]string{}); err == nil {
+		t.Error("expected an error for a feed without a listing")
+	}
+}
+
+func TestRedditSubredditListing(t *testing.T) {
+	source, queries := newRedditTestServer(t, map[string]string{"/r/golang/hot.json": "subreddit.json"})
+	fetchLog := models.NewFetchLog("feed")
+
+	posts, err := source.posts(context.Background(), map[string]string{"listing": "/r/golang", "min_score": "1"}, fetchLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchLog.StatusCode != http.StatusOK || fetchLog.ItemCount != 5 {
+		t.Errorf("fetch log = %d status, %d items", fetchLog.StatusCode, fetchLog.ItemCount)
+	}
+	if queries["/r/golang/hot.json"].Get("raw_json") != "1" {
+		t.Errorf("query = %v, want raw_json", queries["/r/golang/hot.json"])
+	}
+
+	// The pinned thread and the post under the minimum score are skipped
+	var names []string
+	for _, post := range posts {
+		names = append(names, post.Name)
+	}
+	if got := strings.Join(names, ","); got != "t3_1aa0002,t3_1aa0003,t3_1aa0004" {
+		t.Fatalf("posts = %s", got)
+	}
+
+	feed := models.NewFeed("https://www.reddit.com/r/golang/")
+
+	link := redditArticle(feed, posts[0])
+	if link.GUID != "t3_1aa0002" || link.Author != "u/golang_news" {
+		t.Errorf("link post identity = %q by %q", link.GUID, link.Author)
+	}
+	if link.URL != "https://go.dev/blog/go1.22" {
+		t.Errorf("link post URL = %q, want the canonical link", link.URL)
+	}
+	if link.CommentsURL != "https://www.reddit.com/r/golang/comments/1aa0002/go_122_is_released/" {
+		t.Errorf("comments URL = %q", link.CommentsURL)
+	}
+	if link.Description != "Score: 912 | Comments: 164 | r/golang | news" {
+		t.Errorf("description = %q", link.Description)
+	}
+	if link.ImageURL != "https://external-preview.redd.it/go122-preview.png?auto=webp&s=abc" {
+		t.Errorf("image = %q, want the preview", link.ImageURL)
+	}
+	if link.PublishedAt.Unix() != 1707239876 {
+		t.Errorf("published = %v", link.PublishedAt)
+	}
+
+	self := redditArticle(feed, posts[1])
+	if self.URL != self.CommentsURL {
+		t.Errorf("self post URL = %q, want the comments page", self.URL)
+	}
+	if !strings.Contains(self.Content, `href="https://www.reddit.com/r/golang/wiki/faq"`) {
+		t.Errorf("self post content = %q, want relative links resolved", self.Content)
+	}
+
+	image := redditArticle(feed, posts[2])
+	if image.ImageURL != "https://i.redd.it/gopherplush.jpg" {
+		t.Errorf("image post image = %q", image.ImageURL)
+	}
+	if !strings.Contains(image.Content, `<img src="https://i.redd.it/gopherplush.jpg"`) {
+		t.Errorf("image post content = %q", image.Content)
+	}
+}
+
+func TestRedditUserListing(t *testing.T) {
+	source, queries := newRedditTestServer(t, map[string]string{"/user/spez/submitted.json": "user.json"})
+
+	posts, err := source.posts(context.Background(), map[string]string{"listing": "/user/spez/submitted", "sort": "new"}, models.NewFetchLog("feed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queries["/user/spez/submitted.json"].Get("sort") != "new" {
+		t.Errorf("query = %v, want sort=new", queries["/user/spez/submitted.json"])
+	}
+
+	// Comments in the listing are not posts
+	if len(posts) != 2 || posts[0].Name != "t3_1bb0001" || posts[1].Name != "t3_1bb0002" {
+		t.Fatalf("posts = %+v", posts)
+	}
+
+	article := redditArticle(models.NewFeed("https://www.reddit.com/user/spez/submitted/"), posts[0])
+	if want := []string{"announcements", "r/reddit"}; strings.Join(article.Categories, ",") != strings.Join(want, ",") {
+		t.Errorf("categories = %v, want %v", article.Categories, want)
+	}
+}
+
+func TestRedditMultiredditListing(t *testing.T) {
+	source, _ := newRedditTestServer(t, map[string]string{"/user/someone/m/langs/hot.json": "multireddit.json"})
+
+	posts, err := source.posts(context.Background(), map[string]string{"listing": "/user/someone/m/langs"}, models.NewFetchLog("feed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 2 {
+		t.Fatalf("got %d posts, want 2", len(posts))
+	}
+
+	feed := models.NewFeed("https://www.reddit.com/user/someone/m/langs/")
+	for _, post := range posts {
+		article := redditArticle(feed, post)
+		// Placeholder thumbnails such as "default" and "nsfw" are not images
+		if article.ImageURL != "" {
+			t.Errorf("%s: image = %q, want none", post.Name, article.ImageURL)
+		}
+		if !strings.HasPrefix(article.Description, "Score: ") || !strings.Contains(article.Description, post.Subreddit) {
+			t.Errorf("%s: description = %q", post.Name, article.Description)
+		}
+	}
+}
+
+func TestRedditGallery(t *testing.T) {
+	source, _ := newRedditTestServer(t, map[string]string{"/r/bicycling/hot.json": "gallery.json"})
+
+	posts, err := source.posts(context.Background(), map[string]string{"listing": "/r/bicycling"}, models.NewFetchLog("feed"))
+	if err != nil || len(posts) != 1 {
+		t.Fatalf("posts = %+v, err = %v", posts, err)
+	}
+
+	article := redditArticle(models.NewFeed("https://www.reddit.com/r/bicycling/"), posts[0])
+	if article.URL != article.CommentsURL {
+		t.Errorf("gallery URL = %q, want the comments page", article.URL)
+	}
+	if article.ImageURL != "https://preview.redd.it/before1.jpg?width=4000&format=pjpg&s=111" {
+		t.Errorf("image = %q, want the first valid gallery image", article.ImageURL)
+	}
+
+	// Failed media is left out and animated images use their gif
+	if count := strings.Count(article.Content, "<figure>"); count != 3 {
+		t.Errorf("content has %d figures, want 3: %s", count, article.Content)
+	}
+	for _, want := range []string{"before1.jpg", "after1.jpg", "https://i.redd.it/spin1.gif", "After &amp; polished"} {
+		if !strings.Contains(article.Content, want) {
+			t.Errorf("content is missing %q: %s", want, article.Content)
+		}
+	}
+	if strings.Contains(article.Content, "Still processing") {
+		t.Errorf("content includes failed media: %s", article.Content)
+	}
+}
+
+func TestRedditVideo(t *testing.T) {
+	source, _ := newRedditTestServer(t, map[string]string{"/r/timelapse/top.json": "video.json"})
+
+	posts, err := source.posts(context.Background(), map[string]string{"listing": "/r/timelapse", "sort": "top", "time": "all"}, models.NewFetchLog("feed"))
+	if err != nil || len(posts) != 1 {
+		t.Fatalf("posts = %+v, err = %v", posts, err)
+	}
+
+	article := redditArticle(models.NewFeed("https://www.reddit.com/r/timelapse/"), posts[0])
+	if len(article.Enclosures) != 1 {
+		t.Fatalf("enclosures = %+v, want the video", article.Enclosures)
+	}
+	video := article.Enclosures[0]
+	if video.URL != "https://v.redd.it/aurora123/DASH_1080.mp4?source=fallback" || video.Type != "video/mp4" || video.Duration != 42 {
+		t.Errorf("video = %+v", video)
+	}
+	if video.Image != "https://external-preview.redd.it/aurora.png?format=pjpg&s=444" {
+		t.Errorf("poster = %q, want the preview", video.Image)
+	}
+}
+
+func TestRedditListingErrors(t *testing.T) {
+	source, _ := newRedditTestServer(t, map[string]string{})
+	fetchLog := models.NewFetchLog("feed")
+
+	_, err := source.posts(context.Background(), map[string]string{"listing": "/r/doesnotexist"}, fetchLog)
+	if err == nil {
+		t.Fatal("expected an error for a missing subreddit")
+	}
+	if fetchLog.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", fetchLog.StatusCode)
+	}
+}
+
+func TestResolveRedditFeed(t *testing.T) {
+	tests := []struct {
+		input   string
+		title   string
+		options map[string]string
+	}{
+		{"https://www.reddit.com/r/golang", "r/golang", map[string]string{"listing": "/r/golang", "sort": "hot"}},
+		{"https://old.reddit.com/r/golang/top/?t=week", "r/golang", map[string]string{"listing": "/r/golang", "sort": "top", "time": "week"}},
+		{"https://reddit.com/r/golang/new.json", "r/golang", map[string]string{"listing": "/r/golang", "sort": "hot"}},
+		{"https://www.reddit.com/user/spez?sort=new", "u/spez", map[string]string{"listing": "/user/spez/submitted", "sort": "new"}},
+		{"https://www.reddit.com/u/spez/", "u/spez", map[string]string{"listing": "/user/spez/submitted", "sort": "hot"}},
+		{"https://www.reddit.com/user/someone/m/langs/rising", "u/someone/m/langs", map[string]string{"listing": "/user/someone/m/langs", "sort": "rising"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			feed, err := resolveRedditFeed(context.Background(), test.input)
+			if err != nil || feed == nil {
+				t.Fatalf("feed = %v, err = %v", feed, err)
+			}
+			if feed.Kind != models.FeedKindReddit || feed.Title != test.title {
+				t.Errorf("got %s feed %q, want reddit %q", feed.Kind, feed.Title, test.title)
+			}
+			if feed.URL != redditURL+test.options["listing"]+"/" {
+				t.Errorf("URL = %q", feed.URL)
+			}
+			if len(feed.Options) != len(test.options) {
+				t.Errorf("options = %v, want %v", feed.Options, test.options)
+			}
+			for key, value := range test.options {
+				if feed.Options[key] != value {
+					t.Errorf("option %s = %q, want %q", key, feed.Options[key], value)
+				}
+			}
+		})
+	}
+
+	for _, input := range []string{"https://example.com/r/golang", "https://www.reddit.com/", "https://www.reddit.com/about"} {
+		if feed, err := resolveRedditFeed(context.Background(), input); feed != nil || err != nil {
+			t.Errorf("%s: feed = %v, err = %v, want neither", input, feed, err)
+		}
+	}
+}
+
+// The resolved feed's listing is fetched from the source's base URL
+func TestResolvedRedditFeedFetchesListing(t *testing.T) {
+	source, _ := newRedditTestServer(t, map[string]string{"/r/golang/top.json": "subreddit.json"})
+
+	feed, err := resolveRedditFeed(context.Background(), "https://www.reddit.com/r/golang/top/?t=day")
+	if err != nil || feed == nil {
+		t.Fatalf("feed = %v, err = %v", feed, err)
+	}
+
+	posts, err := source.posts(context.Background(), feed.Options, models.NewFetchLog(feed.ID.Hex()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 4 {
+		t.Errorf("got %d posts, want every post but the pinned one", len(posts))
+	}
+}
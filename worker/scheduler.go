@@ -0,0 +1,219 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"redapplications.com/redreader/models"
+)
+
+const (
+	minFetchInterval     = 15 * time.Minute
+	maxFetchInterval     = 12 * time.Hour
+	defaultFetchInterval = time.Hour
+	maxBackoffInterval   = 48 * time.Hour
+	cadenceSampleSize    = 10
+	failingThreshold     = 3
+	goneThreshold        = 5
+)
+
+// FetchError is returned when a feed responds with a non-success status code,
+// carrying any Retry-After the server asked us to honour
+type FetchError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("unexpected status code fetching feed: %d", e.StatusCode)
+}
+
+func newFetchError(resp *http.Response) *FetchError {
+	return &FetchError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+// fetchInterval works out how long to wait before polling a feed again from
+// how often it has published recently, never polling more often than the
+// publisher asks for via ttl or sy:updatePeriod
+func fetchInterval(parsedFeed *gofeed.Feed) time.Duration {
+	interval := publishingCadence(parsedFeed.Items)
+	if hint := publisherHint(parsedFeed); hint > interval {
+		interval = hint
+	}
+	return clampInterval(interval)
+}
+
+func publishingCadence(items []*gofeed.Item) time.Duration {
+	var dates []time.Time
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		if item.PublishedParsed != nil {
+			dates = append(dates, *item.PublishedParsed)
+		} else if item.UpdatedParsed != nil {
+			dates = append(dates, *item.UpdatedParsed)
+		}
+	}
+
+	if len(dates) < 2 {
+		return defaultFetchInterval
+	}
+
+	sort.Slice(dates, func(i, j int) bool { return dates[i].After(dates[j]) })
+	if len(dates) > cadenceSampleSize {
+		dates = dates[:cadenceSampleSize]
+	}
+
+	gaps := make([]time.Duration, 0, len(dates)-1)
+	for i := 1; i < len(dates); i++ {
+		gaps = append(gaps, dates[i-1].Sub(dates[i]))
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+
+	// Poll at half the median gap so a new item is picked up reasonably soon
+	// after it is published
+	return gaps[len(gaps)/2] / 2
+}
+
+func publisherHint(parsedFeed *gofeed.Feed) time.Duration {
+	var hint time.Duration
+
+	if ttl, err := strconv.Atoi(strings.TrimSpace(parsedFeed.Custom["ttl"])); err == nil && ttl > 0 {
+		hint = time.Duration(ttl) * time.Minute
+	}
+
+	sy, ok := parsedFeed.Extensions["sy"]
+	if !ok {
+		return hint
+	}
+
+	var period time.Duration
+	if values := sy["updatePeriod"]; len(values) > 0 {
+		switch strings.ToLower(strings.TrimSpace(values[0].Value)) {
+		case "hourly":
+			period = time.Hour
+		case "daily":
+			period = 24 * time.Hour
+		case "weekly":
+			period = 7 * 24 * time.Hour
+		case "monthly":
+			period = 30 * 24 * time.Hour
+		case "yearly":
+			period = 365 * 24 * time.Hour
+		}
+	}
+
+	if period > 0 {
+		frequency := 1
+		if values := sy["updateFrequency"]; len(values) > 0 {
+			if f, err := strconv.Atoi(strings.TrimSpace(values[0].Value)); err == nil && f > 0 {
+				frequency = f
+			}
+		}
+		if updateHint := period / time.Duration(frequency); updateHint > hint {
+			hint = updateHint
+		}
+	}
+
+	return hint
+}
+
+func clampInterval(interval time.Duration) time.Duration {
+	if interval < minFetchInterval {
+		return minFetchInterval
+	}
+	if interval > maxFetchInterval {
+		return maxFetchInterval
+	}
+	return interval
+}
+
+func backoffInterval(failures int) time.Duration {
+	interval := minFetchInterval
+	for i := 1; i < failures && interval < maxBackoffInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxBackoffInterval {
+		return maxBackoffInterval
+	}
+	return interval
+}
+
+func feedHealth(failures int, fetchErr error) string {
+	var statusErr *FetchError
+	if errors.As(fetchErr, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusGone:
+			return models.FeedHealthGone
+		case statusErr.StatusCode == http.StatusNotFound && failures >= goneThreshold:
+			return models.FeedHealthGone
+		}
+	}
+
+	if failures >= failingThreshold {
+		return models.FeedHealthFailing
+	}
+	return models.FeedHealthDegraded
+}
+
+// reschedule records the outcome of a fetch on the feed and persists when it
+// should next be polled
+func (f *FeedFetcher) reschedule(feed *models.Feed, fetchErr error) error {
+	now := time.Now()
+
+	if fetchErr == nil {
+		if feed.FetchInterval == 0 {
+			feed.FetchInterval = defaultFetchInterval
+		}
+		feed.ConsecutiveFailures = 0
+		feed.LastError = ""
+		feed.Health = models.FeedHealthOK
+		if feed.WebSub.Active(now) {
+			feed.NextFetchAt = now.Add(webSubPollInterval)
+		} else {
+			feed.NextFetchAt = now.Add(feed.FetchInterval)
+		}
+	} else {
+		feed.ConsecutiveFailures++
+		feed.LastError = fetchErr.Error()
+		feed.Health = feedHealth(feed.ConsecutiveFailures, fetchErr)
+
+		wait := backoffInterval(feed.ConsecutiveFailures)
+		var statusErr *FetchError
+		if errors.As(fetchErr, &statusErr) && statusErr.RetryAfter > wait {
+			wait = statusErr.RetryAfter
+		}
+		feed.NextFetchAt = now.Add(wait)
+	}
+
+	return f.feedRepo.UpdateSchedule(feed)
+}
@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+
+	"redapplications.com/redreader/models"
+	"redapplications.com/redreader/repository"
+)
+
+// Source fetches the items of one kind of feed. FeedFetcher schedules every
+// feed the same way, handing the fetch itself to the source registered for
+// the feed's kind.
+type Source interface {
+	// Fetch saves the feed's new and revised items as articles and returns
+	// the ones it created. It records what it did on fetchLog and may set
+	// feed.FetchInterval to suggest how often the feed should be polled.
+	Fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error)
+}
+
+// RegisterSource makes source responsible for fetching feeds of kind
+func (f *FeedFetcher) RegisterSource(kind string, source Source) {
+	f.sources[kind] = source
+}
+
+func (f *FeedFetcher) source(feed *models.Feed) (Source, error) {
+	source, ok := f.sources[feed.SourceKind()]
+	if !ok {
+		return nil, fmt.Errorf("no source for feeds of kind %q", feed.SourceKind())
+	}
+	return source, nil
+}
+
+// rssSource fetches RSS, Atom and JSON feeds over HTTP
+type rssSource struct {
+	fetcher *FeedFetcher
+}
+
+func (s *rssSource) Fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	return s.fetcher.fetch(ctx, feed, fetchLog)
+}
+
+// parsedSource stores a feed document that has already been fetched, so
+// adding a feed doesn't download it a second time
+type parsedSource struct {
+	fetcher    *FeedFetcher
+	parsedFeed *gofeed.Feed
+}
+
+func (s *parsedSource) Fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	fetchLog.StatusCode = http.StatusOK
+	return s.fetcher.store(feed, s.parsedFeed, nil, fetchLog)
+}
+
+// scrapedSource stores a watched page that was already scraped while the
+// feed was being added
+type scrapedSource struct {
+	articleRepo *repository.ArticleRepository
+	page        *WebPagePreview
+}
+
+func (s *scrapedSource) Fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	return storeWebPage(s.articleRepo, feed, s.page, fetchLog)
+}
+
+// pushSource is implemented by sources whose items are delivered to us
+// rather than polled, so the scheduler leaves their feeds alone
+type pushSource interface {
+	PushOnly() bool
+}
+
+// polled reports whether the feed's items have to be fetched on a schedule
+func (f *FeedFetcher) polled(feed *models.Feed) bool {
+	source, err := f.source(feed)
+	if err != nil {
+		// Still attempted, so the missing source shows up in the fetch log
+		return true
+	}
+	push, ok := source.(pushSource)
+	return !ok || !push.PushOnly()
+}
+
+// SourceOption is a setting a source reads from Feed.Options
+type SourceOption struct {
+	Name  string
+	Label string
+	Help  string
+}
+
+// configurableSource is implemented by sources with settings the feed's
+// owner can change
+type configurableSource interface {
+	Options() []SourceOption
+}
+
+// SourceOptions returns the settings understood by the feed's source
+func (f *FeedFetcher) SourceOptions(feed *models.Feed) []SourceOption {
+	source, err := f.source(feed)
+	if err != nil {
+		return nil
+	}
+	if configurable, ok := source.(configurableSource); ok {
+		return configurable.Options()
+	}
+	return nil
+}
+
+// sourceResolver recognises an address fetched by a source other than RSS
+// and returns the feed to create for it, or nil for addresses it doesn't
+// handle
+type sourceResolver func(ctx context.Context, input string) (*models.Feed, error)
+
+// ResolveSourceFeed returns a new, unsaved feed for addresses that are
+// fetched by a dedicated source, such as a subreddit, or nil when the
+// address should be treated as a web page or feed. The user adding the
+// feed is its owner, so their GitHub token can see their private
+// repositories.
+func ResolveSourceFeed(ctx context.Context, input string, user *models.User) (*models.Feed, error) {
+	sourceResolvers := []sourceResolver{
+		resolveRedditFeed,
+		resolveMastodonFeed,
+		func(ctx context.Context, input string) (*models.Feed, error) {
+			return resolveGitHubFeed(ctx, input, user.GitHubToken)
+		},
+	}
+
+	input = strings.TrimSpace(input)
+	for _, resolve := range sourceResolvers {
+		feed, err := resolve(ctx, input)
+		if err != nil || feed != nil {
+			return feed, err
+		}
+	}
+	return nil, nil
+}
+
+// getJSON decodes the JSON document at url into v
+func getJSON(ctx context.Context, url string, v interface{}) (int, error) {
+	return getJSONAccept(ctx, url, "application/json", v)
+}
+
+// getJSONAccept is getJSON for APIs that need a more specific media type
+func getJSONAccept(ctx context.Context, url, accept string, v interface{}) (int, error) {
+	resp, err := httpGetAccept(ctx, url, accept)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, newFetchError(resp)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxFeedSize)).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("invalid JSON response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,206 @@
+package worker
+
+import (
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/atom"
+	"github.com/mmcdole/gofeed/json"
+	"github.com/mmcdole/gofeed/rss"
+)
+
+// rssTranslator keeps the channel fields that the default translator drops
+// but the scheduler needs, stashing them in Feed.Custom
+type rssTranslator struct {
+	gofeed.DefaultRSSTranslator
+}
+
+func (t *rssTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	result, err := t.DefaultRSSTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	rssFeed, ok := feed.(*rss.Feed)
+	if !ok {
+		return result, nil
+	}
+
+	if rssFeed.TTL != "" {
+		setCustom(result, "ttl", rssFeed.TTL)
+	}
+
+	// RSS feeds advertise WebSub hubs through atom:link elements
+	for _, link := range rssFeed.Extensions["atom"]["link"] {
+		switch link.Attrs["rel"] {
+		case "hub":
+			setCustom(result, "hub", link.Attrs["href"])
+		case "self":
+			setCustom(result, "self", link.Attrs["href"])
+		}
+	}
+
+	return result, nil
+}
+
+// atomTranslator keeps the hub and self links, which the default translator
+// flattens into Feed.Links without their rel
+type atomTranslator struct {
+	gofeed.DefaultAtomTranslator
+}
+
+func (t *atomTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	result, err := t.DefaultAtomTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	atomFeed, ok := feed.(*atom.Feed)
+	if !ok {
+		return result, nil
+	}
+
+	for _, link := range atomFeed.Links {
+		switch link.Rel {
+		case "hub":
+			setCustom(result, "hub", link.Href)
+		case "self":
+			setCustom(result, "self", link.Href)
+		}
+	}
+
+	if len(atomFeed.Entries) != len(result.Items) {
+		return result, nil
+	}
+	for i, entry := range atomFeed.Entries {
+		if entry == nil || entry.Content == nil || result.Items[i] == nil {
+			continue
+		}
+		item := result.Items[i]
+		item.Content = atomContent(entry.Content)
+
+		// Out-of-line content lives at its src, which stands in for a
+		// missing alternate link
+		if entry.Content.Src != "" && item.Link == "" {
+			item.Link = entry.Content.Src
+		}
+	}
+
+	return result, nil
+}
+
+// atomContent returns an entry's content as HTML according to its type.
+// Plain text is escaped rather than read as markup, and binary content is
+// dropped.
+func atomContent(content *atom.Content) string {
+	contentType := strings.ToLower(strings.TrimSpace(content.Type))
+	switch {
+	case contentType == "" || contentType == "text":
+		return textToHTML(content.Value)
+	case contentType == "html" || contentType == "xhtml" || contentType == "text/html" ||
+		strings.HasSuffix(contentType, "+xml") || strings.HasSuffix(contentType, "/xml"):
+		return content.Value
+	case strings.HasPrefix(contentType, "text/"):
+		return textToHTML(content.Value)
+	default:
+		return ""
+	}
+}
+
+// jsonTranslator fills in the JSON Feed 1.1 fields the default translator
+// drops or misreads
+type jsonTranslator struct {
+	gofeed.DefaultJSONTranslator
+}
+
+func (t *jsonTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	result, err := t.DefaultJSONTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonFeed, ok := feed.(*json.Feed)
+	if !ok || len(jsonFeed.Items) != len(result.Items) {
+		return result, nil
+	}
+
+	for i, jsonItem := range jsonFeed.Items {
+		item := result.Items[i]
+		if item == nil {
+			continue
+		}
+
+		// content_text and summary are plain text
+		if jsonItem.ContentHTML == "" && jsonItem.ContentText != "" {
+			item.Content = textToHTML(jsonItem.ContentText)
+		}
+		item.Description = html.EscapeString(jsonItem.Summary)
+
+		if item.Link == "" {
+			item.Link = jsonItem.ExternalURL
+		}
+
+		// Items without authors are written by the feed's authors
+		if len(item.Authors) == 0 {
+			item.Authors = result.Authors
+		}
+
+		// The default translator puts the duration where the size belongs
+		if jsonItem.Attachments != nil && len(*jsonItem.Attachments) == len(item.Enclosures) {
+			for j, attachment := range *jsonItem.Attachments {
+				item.Enclosures[j].Length = strconv.FormatInt(attachment.SizeInBytes, 10)
+				if attachment.DurationInSeconds > 0 {
+					setItemCustom(item, "duration", strconv.FormatInt(attachment.DurationInSeconds, 10))
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// textToHTML turns plain text into paragraphs of escaped HTML
+func textToHTML(text string) string {
+	var paragraphs []string
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		paragraph = strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br>")
+		paragraphs = append(paragraphs, "<p>"+paragraph+"</p>")
+	}
+	return strings.Join(paragraphs, "\n")
+}
+
+func setCustom(feed *gofeed.Feed, key, value string) {
+	if value == "" {
+		return
+	}
+	if feed.Custom == nil {
+		feed.Custom = make(map[string]string)
+	}
+	// Keep the first value when an element is repeated
+	if _, exists := feed.Custom[key]; !exists {
+		feed.Custom[key] = value
+	}
+}
+
+func setItemCustom(item *gofeed.Item, key, value string) {
+	if item.Custom == nil {
+		item.Custom = make(map[string]string)
+	}
+	if _, exists := item.Custom[key]; !exists {
+		item.Custom[key] = value
+	}
+}
+
+func newFeedParser() *gofeed.Parser {
+	parser := gofeed.NewParser()
+	parser.RSSTranslator = &rssTranslator{}
+	parser.AtomTranslator = &atomTranslator{}
+	parser.JSONTranslator = &jsonTranslator{}
+	return parser
+}
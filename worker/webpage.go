@@ -0,0 +1,277 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"redapplications.com/redreader/models"
+	"redapplications.com/redreader/repository"
+	"redapplications.com/redreader/sanitize"
+)
+
+const (
+	webPageFetchInterval = time.Hour
+	maxWebPageItems      = 50
+	webPagePreviewItems  = 10
+)
+
+// webPageSelectors are the options naming the CSS selectors a watched page
+// is scraped with. Only the item selector is required.
+var webPageSelectors = []string{"item", "title", "link", "date"}
+
+// webPageSource turns pages without a feed into one by picking items out of
+// the page with CSS selectors chosen when the feed was added
+type webPageSource struct {
+	articleRepo *repository.ArticleRepository
+}
+
+func newWebPageSource(articleRepo *repository.ArticleRepository) *webPageSource {
+	return &webPageSource{articleRepo: articleRepo}
+}
+
+func (s *webPageSource) Options() []SourceOption {
+	return []SourceOption{
+		{Name: "item", Label: "Item selector", Help: "CSS selector matching each entry on the page, such as article or .post"},
+		{Name: "title", Label: "Title selector", Help: "Within an item, the title's element. The link text is used when empty"},
+		{Name: "link", Label: "Link selector", Help: "Within an item, the link to follow. The first link is used when empty"},
+		{Name: "date", Label: "Date selector", Help: "Within an item, the publication date. Its datetime attribute is preferred"},
+	}
+}
+
+// WebPageItem is an entry picked out of a watched page
+type WebPageItem struct {
+	Title     string
+	URL       string
+	Content   string
+	Published time.Time
+}
+
+// WebPagePreview is what a watched page would currently produce
+type WebPagePreview struct {
+	Title string
+	URL   string
+	Items []WebPageItem
+	Total int // How many items were found, previews only keep the first few
+}
+
+func (s *webPageSource) Fetch(ctx context.Context, feed *models.Feed, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	page, err := scrapeWebPage(ctx, feed.URL, feed.Options)
+	if err != nil {
+		return nil, err
+	}
+	return storeWebPage(s.articleRepo, feed, page, fetchLog)
+}
+
+// storeWebPage saves the items scraped from a watched page as articles
+func storeWebPage(articleRepo *repository.ArticleRepository, feed *models.Feed, page *WebPagePreview, fetchLog *models.FetchLog) ([]*models.Article, error) {
+	fetchLog.StatusCode = 200
+	fetchLog.ItemCount = len(page.Items)
+	feed.FetchInterval = webPageFetchInterval
+
+	var created []*models.Article
+	for _, item := range page.Items {
+		article := models.NewArticle(feed.ID.Hex())
+		article.GUID = webPageItemID(item)
+		article.Title = item.Title
+		article.URL = item.URL
+		article.Content = item.Content
+		article.ImageURL = firstContentImage(item.Content)
+		article.PublishedAt = item.Published
+		if article.PublishedAt.IsZero() || article.PublishedAt.After(time.Now()) {
+			// Undated items are dated when they first appear on the page
+			article.PublishedAt = time.Now()
+		}
+
+		result, err := upsertArticle(articleRepo, article)
+		if err != nil {
+			return created, err
+		}
+		switch result {
+		case articleCreated:
+			created = append(created, article)
+			fetchLog.NewArticles++
+		case articleUpdated:
+			fetchLog.UpdatedArticles++
+		}
+	}
+
+	return created, nil
+}
+
+// webPageItemID identifies an item by its link, or by its title for items
+// that don't link anywhere
+func webPageItemID(item WebPageItem) string {
+	if item.URL != "" {
+		return item.URL
+	}
+	sum := sha256.Sum256([]byte(item.Title))
+	return "webpage:" + hex.EncodeToString(sum[:])
+}
+
+// PreviewWebPage scrapes a page with the given selectors without saving
+// anything, so they can be checked before the feed is added
+func PreviewWebPage(ctx context.Context, pageURL string, options map[string]string) (*WebPagePreview, error) {
+	page, err := scrapeWebPage(ctx, pageURL, options)
+	if err != nil {
+		return nil, err
+	}
+	page.Total = len(page.Items)
+	if len(page.Items) > webPagePreviewItems {
+		page.Items = page.Items[:webPagePreviewItems]
+	}
+	return page, nil
+}
+
+// NewWebPageFeed returns a new, unsaved feed watching the page, once its
+// selectors have been checked to find something, along with what was
+// scraped so FetchScraped can store it without reading the page again
+func NewWebPageFeed(ctx context.Context, pageURL string, options map[string]string) (*models.Feed, *WebPagePreview, error) {
+	page, err := scrapeWebPage(ctx, pageURL, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	feed := models.NewFeed(page.URL)
+	feed.Kind = models.FeedKindWebPage
+	feed.Title = page.Title
+	feed.Description = "Watching " + page.URL
+	feed.Options = make(map[string]string)
+	for _, name := range webPageSelectors {
+		if selector := strings.TrimSpace(options[name]); selector != "" {
+			feed.Options[name] = selector
+		}
+	}
+	return feed, page, nil
+}
+
+func scrapeWebPage(ctx context.Context, pageURL string, options map[string]string) (*WebPagePreview, error) {
+	parsed, err := url.Parse(strings.TrimSpace(pageURL))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid URL: %s", pageURL)
+	}
+	if strings.TrimSpace(options["item"]) == "" {
+		return nil, errors.New("an item selector is required")
+	}
+	for _, name := range webPageSelectors {
+		if selector := strings.TrimSpace(options[name]); selector != "" {
+			if _, err := cascadia.Compile(selector); err != nil {
+				return nil, fmt.Errorf("invalid %s selector %q: %v", name, selector, err)
+			}
+		}
+	}
+
+	body, finalURL, err := fetchDocument(ctx, parsed.String())
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := extractWebPage(body, finalURL, options)
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Items) == 0 {
+		return nil, errors.New("the item selector didn't match anything on the page")
+	}
+	return page, nil
+}
+
+func extractWebPage(body []byte, base *url.URL, options map[string]string) (*WebPagePreview, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	page := &WebPagePreview{
+		Title: collapseText(doc.Find("title").First().Text()),
+		URL:   base.String(),
+	}
+	if page.Title == "" {
+		page.Title = base.Host + base.Path
+	}
+
+	seen := make(map[string]bool)
+	doc.Find(strings.TrimSpace(options["item"])).EachWithBreak(func(_ int, container *goquery.Selection) bool {
+		item := webPageItem(container, base, options)
+		if item.Title == "" && item.URL == "" {
+			return true
+		}
+		// Pages often repeat an entry, e.g. in a featured slot
+		if id := webPageItemID(item); !seen[id] {
+			seen[id] = true
+			page.Items = append(page.Items, item)
+		}
+		return len(page.Items) < maxWebPageItems
+	})
+	return page, nil
+}
+
+func webPageItem(container *goquery.Selection, base *url.URL, options map[string]string) WebPageItem {
+	var item WebPageItem
+
+	link := container.Filter("a[href]")
+	if selector := strings.TrimSpace(options["link"]); selector != "" {
+		link = container.Find(selector).First()
+		if _, ok := link.Attr("href"); !ok {
+			link = link.Find("a[href]").First()
+		}
+	} else if link.Length() == 0 {
+		link = container.Find("a[href]").First()
+	}
+	if href, ok := link.Attr("href"); ok {
+		if resolved, err := base.Parse(strings.TrimSpace(href)); err == nil && (resolved.Scheme == "http" || resolved.Scheme == "https") {
+			item.URL = resolved.String()
+		}
+	}
+
+	if selector := strings.TrimSpace(options["title"]); selector != "" {
+		item.Title = collapseText(container.Find(selector).First().Text())
+	}
+	if item.Title == "" {
+		item.Title = collapseText(link.Text())
+	}
+
+	if selector := strings.TrimSpace(options["date"]); selector != "" {
+		date := container.Find(selector).First()
+		item.Published = webPageDate(date.AttrOr("datetime", date.Text()))
+	}
+
+	if content, err := goquery.OuterHtml(container); err == nil {
+		item.Content = sanitize.ResolveURLs(content, base.String())
+	}
+	return item
+}
+
+// Pages write dates for people, so a few more layouts are tried than feeds need
+var webPageDateLayouts = []string{
+	time.RFC3339,
+	"2 January 2006",
+	"2 Jan 2006",
+	"Monday, January 2, 2006",
+	"Mon, Jan 2, 2006",
+}
+
+func webPageDate(raw string) time.Time {
+	raw = collapseText(raw)
+	for _, layout := range webPageDateLayouts {
+		if parsed, err := time.Parse(layout, raw); err == nil {
+			return parsed
+		}
+	}
+	if parsed, ok := parseLooseDate(raw); ok && parsed.After(earliestPublishDate) {
+		return parsed
+	}
+	return time.Time{}
+}
+
+func collapseText(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
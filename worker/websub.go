@@ -0,0 +1,317 @@
+package worker
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"redapplications.com/redreader/models"
+	"redapplications.com/redreader/repository"
+)
+
+const (
+	webSubLeaseSeconds   = 10 * 24 * 60 * 60
+	webSubRenewBefore    = 24 * time.Hour
+	webSubPendingTimeout = time.Hour
+	webSubRetryInterval  = 24 * time.Hour
+	// While a hub is pushing updates we still poll occasionally in case it
+	// silently stops delivering
+	webSubPollInterval = maxFetchInterval
+)
+
+var (
+	ErrWebSubUnknownFeed      = errors.New("websub: unknown feed")
+	ErrWebSubTopicMismatch    = errors.New("websub: topic does not match subscription")
+	ErrWebSubInvalidSignature = errors.New("websub: invalid signature")
+)
+
+// updateHub records the hub advertised by a freshly fetched feed, resetting
+// the subscription when the hub changes or disappears so the feed falls back
+// to normal polling
+func (f *FeedFetcher) updateHub(feed *models.Feed, parsedFeed *gofeed.Feed, header http.Header) {
+	hub, self := hubLinks(header)
+	if hub == "" {
+		hub = parsedFeed.Custom["hub"]
+	}
+	if self == "" {
+		self = parsedFeed.Custom["self"]
+	}
+	if self == "" {
+		self = feed.URL
+	}
+
+	if hub == feed.WebSub.HubURL && self == feed.WebSub.Topic {
+		return
+	}
+
+	feed.WebSub = models.WebSubSubscription{}
+	if hub != "" {
+		feed.WebSub.HubURL = hub
+		feed.WebSub.Topic = self
+		feed.WebSub.RenewAt = time.Now()
+	}
+
+	if err := f.feedRepo.UpdateWebSub(feed); err != nil {
+		println("Error saving WebSub hub:", feed.Title, err.Error())
+	}
+}
+
+// hubLinks reads the hub and self links from HTTP Link headers
+func hubLinks(header http.Header) (hub string, self string) {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, param := range parts[1:] {
+				key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || !strings.EqualFold(key, "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(val, `"`)) {
+					switch strings.ToLower(rel) {
+					case "hub":
+						if hub == "" {
+							hub = target
+						}
+					case "self":
+						if self == "" {
+							self = target
+						}
+					}
+				}
+			}
+		}
+	}
+	return hub, self
+}
+
+// WebSubManager subscribes feeds to the hubs they advertise and handles the
+// hub's callbacks. Subscriptions are only made when PUBLIC_URL is set, since
+// hubs need a publicly reachable callback.
+type WebSubManager struct {
+	feedRepo     *repository.FeedRepository
+	fetcher      *FeedFetcher
+	callbackBase string
+	client       *http.Client
+}
+
+func NewWebSubManager(feedRepo *repository.FeedRepository, fetcher *FeedFetcher) *WebSubManager {
+	return &WebSubManager{
+		feedRepo:     feedRepo,
+		fetcher:      fetcher,
+		callbackBase: strings.TrimRight(os.Getenv("PUBLIC_URL"), "/"),
+		client:       &http.Client{Timeout: fetchTimeout},
+	}
+}
+
+func (m *WebSubManager) Enabled() bool {
+	return m.callbackBase != ""
+}
+
+func (m *WebSubManager) callbackURL(feed *models.Feed) string {
+	return m.callbackBase + "/websub/" + feed.ID.Hex()
+}
+
+// SubscribeDue creates, retries or renews every subscription that is due
+func (m *WebSubManager) SubscribeDue(ctx context.Context) error {
+	if !m.Enabled() {
+		return nil
+	}
+
+	feeds, err := m.feedRepo.GetWebSubFeedsDue(time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, feed := range feeds {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := m.Subscribe(ctx, feed); err != nil {
+			println("Error subscribing to WebSub hub:", feed.Title, err.Error())
+		}
+	}
+	return nil
+}
+
+// Subscribe asks the feed's hub to start pushing updates. The subscription
+// stays pending until the hub verifies our intent on the callback, and the
+// current secret keeps signing pushes until then. The request is saved
+// before it is sent, as hubs may verify it before answering.
+func (m *WebSubManager) Subscribe(ctx context.Context, feed *models.Feed) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	feed.WebSub.PendingSecret = hex.EncodeToString(secret)
+	feed.WebSub.PendingUntil = time.Now().Add(webSubPendingTimeout)
+	feed.WebSub.RenewAt = feed.WebSub.PendingUntil
+	if !feed.WebSub.Active(time.Now()) {
+		feed.WebSub.State = models.WebSubStatePending
+	}
+	// Renewing a live subscription keeps its state, so pushes are still
+	// received until the hub verifies the renewal
+	if err := m.feedRepo.StartWebSubRequest(feed); err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {feed.WebSub.Topic},
+		"hub.callback":      {m.callbackURL(feed)},
+		"hub.secret":        {feed.WebSub.PendingSecret},
+		"hub.lease_seconds": {strconv.Itoa(webSubLeaseSeconds)},
+	}
+
+	if err := m.postToHub(ctx, feed.WebSub.HubURL, form); err != nil {
+		if saveErr := m.feedRepo.FailWebSubRequest(feed.ID, feed.WebSub.PendingSecret, time.Now().Add(webSubRetryInterval)); saveErr != nil {
+			return saveErr
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *WebSubManager) postToHub(ctx context.Context, hubURL string, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hubURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("hub rejected subscription with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// VerifyIntent handles the hub's GET to the callback, returning the challenge
+// to echo back when the request matches a subscription we asked for. Anyone
+// can call the callback, so subscribe and denied are only honoured while our
+// own subscribe request is waiting on the hub.
+func (m *WebSubManager) VerifyIntent(feedID string, query url.Values) (string, error) {
+	feed, err := m.feedRepo.GetFeed(feedID)
+	if err != nil {
+		return "", ErrWebSubUnknownFeed
+	}
+
+	if query.Get("hub.topic") != feed.WebSub.Topic {
+		return "", ErrWebSubTopicMismatch
+	}
+
+	now := time.Now()
+	mode := query.Get("hub.mode")
+	if (mode == "subscribe" || mode == "denied") && (feed.WebSub.HubURL == "" || !feed.WebSub.AwaitingVerification(now)) {
+		return "", ErrWebSubTopicMismatch
+	}
+
+	switch mode {
+	case "subscribe":
+		// Hubs may grant a shorter lease than we asked for but never a
+		// missing or longer one
+		lease, err := strconv.Atoi(query.Get("hub.lease_seconds"))
+		if err != nil || lease <= 0 || lease > webSubLeaseSeconds {
+			return "", ErrWebSubTopicMismatch
+		}
+
+		feed.WebSub.Secret = feed.WebSub.PendingSecret
+		feed.WebSub.PendingSecret = ""
+		feed.WebSub.PendingUntil = time.Time{}
+		feed.WebSub.State = models.WebSubStateSubscribed
+		feed.WebSub.LeaseExpires = now.Add(time.Duration(lease) * time.Second)
+		feed.WebSub.RenewAt = feed.WebSub.LeaseExpires.Add(-webSubRenewBefore)
+		if feed.WebSub.RenewAt.Before(now) {
+			feed.WebSub.RenewAt = now.Add(feed.WebSub.LeaseExpires.Sub(now) / 2)
+		}
+	case "unsubscribe":
+		// We never unsubscribe while still following a hub
+		if feed.WebSub.HubURL != "" {
+			return "", ErrWebSubTopicMismatch
+		}
+		return query.Get("hub.challenge"), nil
+	case "denied":
+		feed.WebSub.PendingSecret = ""
+		feed.WebSub.PendingUntil = time.Time{}
+		feed.WebSub.State = models.WebSubStateFailed
+		feed.WebSub.RenewAt = time.Now().Add(webSubRetryInterval)
+	default:
+		return "", ErrWebSubTopicMismatch
+	}
+
+	if err := m.feedRepo.UpdateWebSub(feed); err != nil {
+		return "", err
+	}
+	return query.Get("hub.challenge"), nil
+}
+
+// Receive ingests content pushed by the hub after checking its signature
+func (m *WebSubManager) Receive(feedID string, signature string, contentType string, body []byte) error {
+	feed, err := m.feedRepo.GetFeed(feedID)
+	if err != nil {
+		return ErrWebSubUnknownFeed
+	}
+
+	if feed.WebSub.Secret == "" || !validSignature(feed.WebSub.Secret, signature, body) {
+		return ErrWebSubInvalidSignature
+	}
+
+	parsedFeed, err := parseFeed(body, contentType)
+	if err != nil {
+		return err
+	}
+
+	created, _, err := m.fetcher.saveItems(feed, parsedFeed)
+	m.fetcher.enrichArticles(feed, created)
+	return err
+}
+
+func validSignature(secret string, signature string, body []byte) bool {
+	method, expected, ok := strings.Cut(signature, "=")
+	if !ok {
+		return false
+	}
+
+	var newHash func() hash.Hash
+	switch strings.ToLower(method) {
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha384":
+		newHash = sha512.New384
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return false
+	}
+
+	expectedMAC, err := hex.DecodeString(expected)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expectedMAC)
+}
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"testing"
+	"time"
+
+	"redapplications.com/redreader/models"
+)
+
+func sign(newHash func() hash.Hash, secret string, body []byte) string {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	secret := "s3cret"
+	body := []byte(`<feed><title>Pushed</title></feed>`)
+
+	tests := []struct {
+		name      string
+		signature string
+		body      []byte
+		valid     bool
+	}{
+		{"sha1", "sha1=" + sign(sha1.New, secret, body), body, true},
+		{"sha256", "sha256=" + sign(sha256.New, secret, body), body, true},
+		{"sha384", "sha384=" + sign(sha512.New384, secret, body), body, true},
+		{"sha512", "sha512=" + sign(sha512.New, secret, body), body, true},
+		{"upper case method", "SHA256=" + sign(sha256.New, secret, body), body, true},
+		{"changed body", "sha256=" + sign(sha256.New, secret, body), []byte(`<feed><title>Forged</title></feed>`), false},
+		{"other secret", "sha256=" + sign(sha256.New, "guess", body), body, false},
+		{"method mismatch", "sha512=" + sign(sha256.New, secret, body), body, false},
+		{"unknown method", "md5=" + sign(sha256.New, secret, body), body, false},
+		{"no method", sign(sha256.New, secret, body), body, false},
+		{"not hex", "sha256=zz", body, false},
+		{"empty", "", body, false},
+		{"truncated digest", "sha256=" + sign(sha256.New, secret, body)[:32], body, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := validSignature(secret, test.signature, test.body); got != test.valid {
+				t.Errorf("validSignature(%q) = %v, want %v", test.signature, got, test.valid)
+			}
+		})
+	}
+}
+
+func TestHubLinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		hub    string
+		self   string
+	}{
+		{"separate headers", []string{`<https://hub.example.com/>; rel="hub"`, `<https://example.com/feed>; rel="self"`}, "https://hub.example.com/", "https://example.com/feed"},
+		{"one header", []string{`<https://hub.example.com/>; rel=hub, <https://example.com/feed>; rel=self`}, "https://hub.example.com/", "https://example.com/feed"},
+		{"several rels", []string{`<https://example.com/feed>; rel="alternate self"`}, "", "https://example.com/feed"},
+		{"first hub wins", []string{`<https://one.example.com/>; rel="hub", <https://two.example.com/>; rel="hub"`}, "https://one.example.com/", ""},
+		{"other links", []string{`<https://example.com/next>; rel="next"`}, "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, value := range test.values {
+				header.Add("Link", value)
+			}
+			hub, self := hubLinks(header)
+			if hub != test.hub || self != test.self {
+				t.Errorf("got hub %q, self %q, want %q, %q", hub, self, test.hub, test.self)
+			}
+		})
+	}
+}
+
+func TestWebSubAwaitingVerification(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		sub    models.WebSubSubscription
+		expect bool
+	}{
+		{"pending", models.WebSubSubscription{PendingSecret: "s", PendingUntil: now.Add(time.Minute)}, true},
+		{"expired", models.WebSubSubscription{PendingSecret: "s", PendingUntil: now.Add(-time.Minute)}, false},
+		{"nothing asked", models.WebSubSubscription{Secret: "s", State: models.WebSubStateSubscribed}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.sub.AwaitingVerification(now); got != test.expect {
+				t.Errorf("AwaitingVerification = %v, want %v", got, test.expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package worker
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+	"redapplications.com/redreader/models"
+)
+
+const (
+	youtubeFeedURL  = "https://www.youtube.com/feeds/videos.xml"
+	youtubeWatchURL = "https://www.youtube.com/watch?v="
+)
+
+var youtubeChannelID = regexp.MustCompile(`^UC[\w-]{22}$`)
+
+// Channel pages name their ID in several places, any of which may be missing
+var youtubePageChannelID = []*regexp.Regexp{
+	regexp.MustCompile(`<meta itemprop="(?:channelId|identifier)" content="(UC[\w-]{22})"`),
+	regexp.MustCompile(`<link rel="canonical" href="https://www\.youtube\.com/channel/(UC[\w-]{22})"`),
+	regexp.MustCompile(`"(?:channelId|externalId)":"(UC[\w-]{22})"`),
+}
+
+func isYouTubeHost(host string) bool {
+	host = strings.ToLower(host)
+	return host == "youtube.com" || host == "www.youtube.com" || host == "m.youtube.com"
+}
+
+// resolveYouTubeFeed returns the Atom feed behind a YouTube channel, handle,
+// user or playlist address. ok is false for addresses that aren't YouTube
+// pages with a feed.
+func resolveYouTubeFeed(ctx context.Context, page *url.URL) (feedURL string, ok bool, err error) {
+	if !isYouTubeHost(page.Hostname()) || strings.HasPrefix(page.Path, "/feeds/") {
+		return "", false, nil
+	}
+
+	if playlist := page.Query().Get("list"); playlist != "" {
+		return youtubeFeedURL + "?playlist_id=" + url.QueryEscape(playlist), true, nil
+	}
+
+	segments := strings.Split(strings.Trim(page.Path, "/"), "/")
+	switch {
+	case len(segments) >= 2 && segments[0] == "channel" && youtubeChannelID.MatchString(segments[1]):
+		return youtubeFeedURL + "?channel_id=" + segments[1], true, nil
+	case len(segments) >= 1 && strings.HasPrefix(segments[0], "@"),
+		len(segments) >= 2 && (segments[0] == "c" || segments[0] == "user"):
+	default:
+		return "", false, nil
+	}
+
+	// Handles and custom URLs only lead to the channel ID through the page
+	channelPage := &url.URL{Scheme: "https", Host: "www.youtube.com", Path: "/" + strings.Join(segments[:min(len(segments), 2)], "/")}
+	if strings.HasPrefix(segments[0], "@") {
+		channelPage.Path = "/" + segments[0]
+	}
+	body, _, err := fetchDocument(ctx, channelPage.String())
+	if err != nil {
+		if segments[0] == "user" {
+			// Legacy usernames still have a feed of their own
+			return youtubeFeedURL + "?user=" + url.QueryEscape(segments[1]), true, nil
+		}
+		return "", true, err
+	}
+	for _, pattern := range youtubePageChannelID {
+		if match := pattern.FindSubmatch(body); match != nil {
+			return youtubeFeedURL + "?channel_id=" + string(match[1]), true, nil
+		}
+	}
+	return "", true, errYouTubeChannelNotFound
+}
+
+// youtubeEnclosure describes the video of an entry in a YouTube feed, using
+// the yt:videoId and media:group elements those feeds carry
+func youtubeEnclosure(item *gofeed.Item) (models.Enclosure, bool) {
+	videoIDs := item.Extensions["yt"]["videoId"]
+	if len(videoIDs) == 0 || videoIDs[0].Value == "" {
+		return models.Enclosure{}, false
+	}
+
+	enclosure := models.Enclosure{
+		URL:  youtubeWatchURL + videoIDs[0].Value,
+		Type: models.YouTubeVideoType,
+	}
+	for _, group := range item.Extensions["media"]["group"] {
+		if thumbnails := group.Children["thumbnail"]; len(thumbnails) > 0 {
+			enclosure.Image = thumbnails[0].Attrs["url"]
+		}
+		for _, content := range group.Children["content"] {
+			if duration := parseDuration(content.Attrs["duration"]); duration > 0 {
+				enclosure.Duration = duration
+			}
+		}
+	}
+	return enclosure, true
+}
+
+// mediaDescription returns the plain text Media RSS description of an item,
+// which is all YouTube feeds carry
+func mediaDescription(item *gofeed.Item) string {
+	media := item.Extensions["media"]
+	if descriptions := media["description"]; len(descriptions) > 0 {
+		return descriptions[0].Value
+	}
+	for _, group := range media["group"] {
+		if descriptions := group.Children["description"]; len(descriptions) > 0 {
+			return descriptions[0].Value
+		}
+	}
+	return ""
+}